@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/asig/mqttlite/internal/server"
+)
+
+// drainOnSignal redirects clients to -server_reference on SIGUSR1.
+func drainOnSignal(srv *server.Server) {
+	sigusr1 := make(chan os.Signal, 1)
+	signal.Notify(sigusr1, syscall.SIGUSR1)
+	go func() {
+		for range sigusr1 {
+			logger.Infof("Got SIGUSR1, draining server")
+			srv.Drain(*flagServerReference, *flagServerMoved)
+		}
+	}()
+}
@@ -1,5 +1,9 @@
 module github.com/asig/mqttlite
 
-go 1.13
+go 1.14
 
-require github.com/asig/go-logging v0.0.0-20150121094138-5f3d38506301
+require (
+	github.com/asig/go-logging v0.0.0-20150121094138-5f3d38506301
+	github.com/gorilla/websocket v1.5.0
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
+)
@@ -41,6 +41,7 @@ const (
 	PingReq     MessageType = 12
 	PingResp    MessageType = 13
 	Disconnect  MessageType = 14
+	Auth        MessageType = 15 // MQTT 5 only
 )
 
 type Message struct {
@@ -57,6 +58,9 @@ const (
 	ErrTimeout
 	ErrMalformedRemainingLength
 	ErrOther
+	ErrMalformedPacket
+	ErrProtocolError
+	ErrPacketTooLarge
 )
 
 func encodeLength(l int) []byte {
@@ -76,6 +80,11 @@ func encodeLength(l int) []byte {
 	return buf
 }
 
+// Size returns the number of bytes msg takes on the wire.
+func (msg *Message) Size() int {
+	return 1 + len(encodeLength(len(msg.Data))) + len(msg.Data)
+}
+
 func (msg *Message) Send(conn net.Conn) {
 	var buf []byte
 	buf = append(buf, byte(msg.Type<<4)|byte(msg.Flags))
@@ -85,6 +94,9 @@ func (msg *Message) Send(conn net.Conn) {
 }
 
 func readBytes(conn net.Conn, timeout time.Duration, b []byte) Error {
+	if len(b) == 0 {
+		return ErrNone
+	}
 	conn.SetReadDeadline(time.Now().Add(timeout))
 	pos := 0
 	remaining := len(b)
@@ -95,6 +107,8 @@ func readBytes(conn net.Conn, timeout time.Duration, b []byte) Error {
 			return ErrTimeout
 		} else if err == io.EOF {
 			return ErrEof
+		} else if err != nil {
+			return ErrOther
 		}
 		for i := 0; i < read; i++ {
 			b[pos] = buf[i]
@@ -116,7 +130,10 @@ func readByte(conn net.Conn, timeout time.Duration) (byte, Error) {
 	return b[0], err
 }
 
-func ReadMessageWithTimeout(conn net.Conn, timeout time.Duration) (*Message, Error) {
+// ReadMessageWithTimeout reads the next message from conn. Messages larger
+// than maxSize bytes are rejected with ErrPacketTooLarge before their
+// payload is read. A maxSize of 0 means no limit.
+func ReadMessageWithTimeout(conn net.Conn, timeout time.Duration, maxSize int) (*Message, Error) {
 	var b byte
 	var err Error
 
@@ -145,6 +162,11 @@ func ReadMessageWithTimeout(conn net.Conn, timeout time.Duration) (*Message, Err
 			return nil, ErrMalformedRemainingLength
 		}
 	}
+	// Fixed header byte, remaining length, and the rest of the message
+	size := 1 + shift/7 + 1 + int(l)
+	if maxSize > 0 && size > maxSize {
+		return nil, ErrPacketTooLarge
+	}
 	msg.Data = make([]byte, l)
 	if err = readBytes(conn, timeout, msg.Data); err != ErrNone {
 		return nil, err
@@ -19,7 +19,10 @@
 package messages
 
 import (
+	"net"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func compareBytes(t *testing.T, got, want []byte) {
@@ -64,6 +67,34 @@ func TestEncodeLength(t *testing.T) {
 	}
 }
 
+func TestReadMessageMaxSize(t *testing.T) {
+	msg := &Message{Type: Publish, Flags: 0, Data: make([]byte, 200)}
+	tests := []struct {
+		desc    string
+		maxSize int
+		want    Error
+	}{
+		{"No limit", 0, ErrNone},
+		{"Exact fit", msg.Size(), ErrNone},
+		{"Too large", msg.Size() - 1, ErrPacketTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go msg.Send(client)
+			got, err := ReadMessageWithTimeout(server, time.Second, test.maxSize)
+			if err != test.want {
+				t.Fatalf("Got error %d, want %d", err, test.want)
+			}
+			if err == ErrNone && len(got.Data) != len(msg.Data) {
+				t.Errorf("Got %d bytes, want %d", len(got.Data), len(msg.Data))
+			}
+		})
+	}
+}
+
 func TestPayloadWriter(t *testing.T) {
 	tests := []struct {
 		desc string
@@ -92,3 +123,108 @@ func TestPayloadWriter(t *testing.T) {
 		})
 	}
 }
+
+func TestPropertiesRoundTrip(t *testing.T) {
+	props := &Properties{
+		PayloadFormatIndicator:      1,
+		MessageExpiryInterval:       Uint32(0),
+		ContentType:                 "text/plain",
+		ResponseTopic:               "replies/1",
+		CorrelationData:             []byte{1, 2, 3},
+		SubscriptionIdentifiers:     []uint32{1, 268435455},
+		SessionExpiryInterval:       Uint32(3600),
+		ServerKeepAlive:             Uint16(30),
+		RequestProblemInformation:   Bool(false),
+		ReceiveMaximum:              10,
+		TopicAlias:                  3,
+		MaximumQoS:                  new(byte),
+		RetainAvailable:             Bool(true),
+		UserProperties:              []UserProperty{{"a", "1"}, {"a", "2"}},
+		MaximumPacketSize:           1 << 20,
+		SharedSubscriptionAvailable: Bool(false),
+	}
+	msg := &Message{Publish, 0, []byte{}}
+	pw := msg.PayloadWriter()
+	pw.WriteProperties(props)
+	pw.WriteUint8(42)
+
+	pr := msg.PayloadReader(0)
+	got, err := pr.GetProperties()
+	if err != ErrNone {
+		t.Fatalf("GetProperties: got error %d", err)
+	}
+	if !reflect.DeepEqual(got, props) {
+		t.Errorf("GetProperties: got %+v, want %+v", got, props)
+	}
+	if b := pr.GetUint8(); b != 42 {
+		t.Errorf("Byte after properties: got %d, want 42", b)
+	}
+}
+
+func TestGetPropertiesErrors(t *testing.T) {
+	tests := []struct {
+		desc string
+		data []byte
+		want Error
+	}{
+		{
+			desc: "Empty",
+			data: []byte{0},
+			want: ErrNone,
+		},
+		{
+			desc: "Truncated property",
+			data: []byte{4, PropTopicAlias, 0, 1, PropReceiveMaximum},
+			want: ErrMalformedPacket,
+		},
+		{
+			desc: "Duplicate property",
+			data: []byte{6, PropTopicAlias, 0, 1, PropTopicAlias, 0, 2},
+			want: ErrProtocolError,
+		},
+		{
+			desc: "Unknown property",
+			data: []byte{2, 0x7f, 0},
+			want: ErrMalformedPacket,
+		},
+		{
+			desc: "Length exceeds packet",
+			data: []byte{5, PropTopicAlias, 0, 1},
+			want: ErrMalformedPacket,
+		},
+		{
+			desc: "Truncated string",
+			data: []byte{4, PropContentType, 0, 5, 'a'},
+			want: ErrMalformedPacket,
+		},
+		{
+			desc: "Receive maximum 0",
+			data: []byte{3, PropReceiveMaximum, 0, 0},
+			want: ErrProtocolError,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			msg := &Message{Publish, 0, test.data}
+			if _, got := msg.PayloadReader(0).GetProperties(); got != test.want {
+				t.Errorf("Got error %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVarInt(t *testing.T) {
+	for _, v := range []uint32{0, 127, 128, 16383, 16384, 2097151, 2097152, 268435455} {
+		msg := &Message{Publish, 0, []byte{}}
+		msg.PayloadWriter().WriteVarInt(v)
+		got, err := msg.PayloadReader(0).GetVarInt()
+		if err != ErrNone || got != v {
+			t.Errorf("GetVarInt: got %d, %d, want %d", got, err, v)
+		}
+	}
+	msg := &Message{Publish, 0, []byte{0xff, 0xff, 0xff, 0xff, 0x01}}
+	if _, err := msg.PayloadReader(0).GetVarInt(); err != ErrMalformedPacket {
+		t.Errorf("GetVarInt with 5 bytes: got error %d, want %d", err, ErrMalformedPacket)
+	}
+}
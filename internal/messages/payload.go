@@ -50,6 +50,91 @@ func (p *PayloadReader) GetString() string {
 	return string(p.GetBytes())
 }
 
+func (p *PayloadReader) GetUint32() uint32 {
+	res := uint32(p.GetUint16())<<16 | uint32(p.GetUint16())
+	return res
+}
+
+// GetVarInt reads a variable byte integer.
+func (p *PayloadReader) GetVarInt() (uint32, Error) {
+	var res uint32
+	for shift := uint(0); shift <= 21; shift += 7 {
+		b, ok := p.getUint8()
+		if !ok {
+			return 0, ErrMalformedPacket
+		}
+		res |= uint32(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return res, ErrNone
+		}
+	}
+	return 0, ErrMalformedPacket
+}
+
+// GetProperties reads the properties of an MQTT 5 packet.
+func (p *PayloadReader) GetProperties() (*Properties, Error) {
+	l, err := p.GetVarInt()
+	if err != ErrNone {
+		return nil, err
+	}
+	if !p.has(int(l)) {
+		return nil, ErrMalformedPacket
+	}
+	props, err := DecodeProperties(p.msg.Data[p.curPos : int(p.curPos)+int(l)])
+	p.curPos += uint16(l)
+	return props, err
+}
+
+// has returns whether at least n more bytes can be read.
+func (p *PayloadReader) has(n int) bool {
+	return int(p.curPos)+n <= len(p.msg.Data) && int(p.curPos)+n <= 0xffff
+}
+
+// The following getters report whether there was enough data instead of
+// panicking.
+
+func (p *PayloadReader) getUint8() (uint8, bool) {
+	if !p.has(1) {
+		return 0, false
+	}
+	return p.GetUint8(), true
+}
+
+func (p *PayloadReader) getBool() (bool, bool) {
+	b, ok := p.getUint8()
+	return b == 1, ok && b <= 1
+}
+
+func (p *PayloadReader) getUint16() (uint16, bool) {
+	if !p.has(2) {
+		return 0, false
+	}
+	return p.GetUint16(), true
+}
+
+func (p *PayloadReader) getUint32() (uint32, bool) {
+	if !p.has(4) {
+		return 0, false
+	}
+	return p.GetUint32(), true
+}
+
+func (p *PayloadReader) getBytes() ([]byte, bool) {
+	if !p.has(2) {
+		return nil, false
+	}
+	l := int(p.msg.Data[p.curPos])<<8 | int(p.msg.Data[p.curPos+1])
+	if !p.has(2 + l) {
+		return nil, false
+	}
+	return p.GetBytes(), true
+}
+
+func (p *PayloadReader) getString() (string, bool) {
+	b, ok := p.getBytes()
+	return string(b), ok
+}
+
 func (p *PayloadReader) GetCurPos() uint16 {
 	return p.curPos
 }
@@ -70,6 +155,24 @@ func (p *PayloadWriter) WriteUint16(v uint16) {
 	p.msg.Data = append(p.msg.Data, []byte{byte(v >> 8), byte(v & 255)}...)
 }
 
+func (p *PayloadWriter) WriteUint32(v uint32) {
+	p.WriteUint16(uint16(v >> 16))
+	p.WriteUint16(uint16(v & 0xffff))
+}
+
+// WriteVarInt writes a variable byte integer.
+func (p *PayloadWriter) WriteVarInt(v uint32) {
+	p.WriteBytes(encodeLength(int(v)))
+}
+
+// WriteProperties writes the properties of an MQTT 5 packet. nil is
+// written as an empty property list.
+func (p *PayloadWriter) WriteProperties(props *Properties) {
+	b := props.Encode()
+	p.WriteVarInt(uint32(len(b)))
+	p.WriteBytes(b)
+}
+
 func (p *PayloadWriter) WriteUint8(v uint8) {
 	p.msg.Data = append(p.msg.Data, v)
 }
@@ -0,0 +1,333 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package messages
+
+// Property identifiers of MQTT 5 packets
+const (
+	PropPayloadFormatIndicator          byte = 0x01
+	PropMessageExpiryInterval           byte = 0x02
+	PropContentType                     byte = 0x03
+	PropResponseTopic                   byte = 0x08
+	PropCorrelationData                 byte = 0x09
+	PropSubscriptionIdentifier          byte = 0x0b
+	PropSessionExpiryInterval           byte = 0x11
+	PropAssignedClientIdentifier        byte = 0x12
+	PropServerKeepAlive                 byte = 0x13
+	PropAuthenticationMethod            byte = 0x15
+	PropAuthenticationData              byte = 0x16
+	PropRequestProblemInformation       byte = 0x17
+	PropWillDelayInterval               byte = 0x18
+	PropRequestResponseInformation      byte = 0x19
+	PropResponseInformation             byte = 0x1a
+	PropServerReference                 byte = 0x1c
+	PropReasonString                    byte = 0x1f
+	PropReceiveMaximum                  byte = 0x21
+	PropTopicAliasMaximum               byte = 0x22
+	PropTopicAlias                      byte = 0x23
+	PropMaximumQoS                      byte = 0x24
+	PropRetainAvailable                 byte = 0x25
+	PropUserProperty                    byte = 0x26
+	PropMaximumPacketSize               byte = 0x27
+	PropWildcardSubscriptionAvailable   byte = 0x28
+	PropSubscriptionIdentifierAvailable byte = 0x29
+	PropSharedSubscriptionAvailable     byte = 0x2a
+)
+
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties of an MQTT 5 packet. Absent properties have their zero value;
+// properties whose absence has a different meaning than their zero value
+// are pointers.
+type Properties struct {
+	PayloadFormatIndicator          byte
+	MessageExpiryInterval           *uint32
+	ContentType                     string
+	ResponseTopic                   string
+	CorrelationData                 []byte
+	SubscriptionIdentifiers         []uint32
+	SessionExpiryInterval           *uint32
+	AssignedClientIdentifier        string
+	ServerKeepAlive                 *uint16
+	AuthenticationMethod            string
+	AuthenticationData              []byte
+	RequestProblemInformation       *bool
+	WillDelayInterval               uint32
+	RequestResponseInformation      bool
+	ResponseInformation             string
+	ServerReference                 string
+	ReasonString                    string
+	ReceiveMaximum                  uint16
+	TopicAliasMaximum               uint16
+	TopicAlias                      uint16
+	MaximumQoS                      *byte
+	RetainAvailable                 *bool
+	UserProperties                  []UserProperty
+	MaximumPacketSize               uint32
+	WildcardSubscriptionAvailable   *bool
+	SubscriptionIdentifierAvailable *bool
+	SharedSubscriptionAvailable     *bool
+}
+
+// Bool returns a pointer to v, for setting optional properties.
+func Bool(v bool) *bool {
+	return &v
+}
+
+// Uint16 returns a pointer to v, for setting optional properties.
+func Uint16(v uint16) *uint16 {
+	return &v
+}
+
+// Uint32 returns a pointer to v, for setting optional properties.
+func Uint32(v uint32) *uint32 {
+	return &v
+}
+
+func encodeBool(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Encode returns the encoded properties without the length prefix.
+func (props *Properties) Encode() []byte {
+	if props == nil {
+		return nil
+	}
+	msg := &Message{}
+	pw := msg.PayloadWriter()
+	writeByte := func(id byte, v byte) {
+		pw.WriteUint8(id)
+		pw.WriteUint8(v)
+	}
+	writeString := func(id byte, s string) {
+		if s != "" {
+			pw.WriteUint8(id)
+			pw.WriteString(s)
+		}
+	}
+	writeBinary := func(id byte, b []byte) {
+		if b != nil {
+			pw.WriteUint8(id)
+			pw.WriteUint16(uint16(len(b)))
+			pw.WriteBytes(b)
+		}
+	}
+	writeUint16 := func(id byte, v uint16) {
+		if v != 0 {
+			pw.WriteUint8(id)
+			pw.WriteUint16(v)
+		}
+	}
+	writeUint32 := func(id byte, v uint32) {
+		if v != 0 {
+			pw.WriteUint8(id)
+			pw.WriteUint32(v)
+		}
+	}
+
+	if props.PayloadFormatIndicator != 0 {
+		writeByte(PropPayloadFormatIndicator, props.PayloadFormatIndicator)
+	}
+	if props.MessageExpiryInterval != nil {
+		pw.WriteUint8(PropMessageExpiryInterval)
+		pw.WriteUint32(*props.MessageExpiryInterval)
+	}
+	writeString(PropContentType, props.ContentType)
+	writeString(PropResponseTopic, props.ResponseTopic)
+	writeBinary(PropCorrelationData, props.CorrelationData)
+	for _, id := range props.SubscriptionIdentifiers {
+		pw.WriteUint8(PropSubscriptionIdentifier)
+		pw.WriteVarInt(id)
+	}
+	if props.SessionExpiryInterval != nil {
+		pw.WriteUint8(PropSessionExpiryInterval)
+		pw.WriteUint32(*props.SessionExpiryInterval)
+	}
+	writeString(PropAssignedClientIdentifier, props.AssignedClientIdentifier)
+	if props.ServerKeepAlive != nil {
+		pw.WriteUint8(PropServerKeepAlive)
+		pw.WriteUint16(*props.ServerKeepAlive)
+	}
+	writeString(PropAuthenticationMethod, props.AuthenticationMethod)
+	writeBinary(PropAuthenticationData, props.AuthenticationData)
+	if props.RequestProblemInformation != nil {
+		writeByte(PropRequestProblemInformation, encodeBool(*props.RequestProblemInformation))
+	}
+	writeUint32(PropWillDelayInterval, props.WillDelayInterval)
+	if props.RequestResponseInformation {
+		writeByte(PropRequestResponseInformation, 1)
+	}
+	writeString(PropResponseInformation, props.ResponseInformation)
+	writeString(PropServerReference, props.ServerReference)
+	writeString(PropReasonString, props.ReasonString)
+	writeUint16(PropReceiveMaximum, props.ReceiveMaximum)
+	writeUint16(PropTopicAliasMaximum, props.TopicAliasMaximum)
+	writeUint16(PropTopicAlias, props.TopicAlias)
+	if props.MaximumQoS != nil {
+		writeByte(PropMaximumQoS, *props.MaximumQoS)
+	}
+	if props.RetainAvailable != nil {
+		writeByte(PropRetainAvailable, encodeBool(*props.RetainAvailable))
+	}
+	for _, up := range props.UserProperties {
+		pw.WriteUint8(PropUserProperty)
+		pw.WriteString(up.Key)
+		pw.WriteString(up.Value)
+	}
+	writeUint32(PropMaximumPacketSize, props.MaximumPacketSize)
+	if props.WildcardSubscriptionAvailable != nil {
+		writeByte(PropWildcardSubscriptionAvailable, encodeBool(*props.WildcardSubscriptionAvailable))
+	}
+	if props.SubscriptionIdentifierAvailable != nil {
+		writeByte(PropSubscriptionIdentifierAvailable, encodeBool(*props.SubscriptionIdentifierAvailable))
+	}
+	if props.SharedSubscriptionAvailable != nil {
+		writeByte(PropSharedSubscriptionAvailable, encodeBool(*props.SharedSubscriptionAvailable))
+	}
+	return msg.Data
+}
+
+// DecodeProperties decodes the properties in b, which must not contain the
+// length prefix.
+func DecodeProperties(b []byte) (*Properties, Error) {
+	props := &Properties{}
+	pr := &PayloadReader{&Message{Data: b}, 0}
+	seen := make(map[byte]bool)
+	for !pr.AtEnd() {
+		id, ok := pr.getUint8()
+		if !ok {
+			return nil, ErrMalformedPacket
+		}
+		// [MQTT5-2.2.2-2]: Only user properties and subscription
+		// identifiers may appear more than once.
+		if seen[id] && id != PropUserProperty && id != PropSubscriptionIdentifier {
+			return nil, ErrProtocolError
+		}
+		seen[id] = true
+
+		ok = true
+		var v8 byte
+		var v16 uint16
+		var v32 uint32
+		switch id {
+		case PropPayloadFormatIndicator:
+			if v8, ok = pr.getUint8(); ok && v8 > 1 {
+				return nil, ErrProtocolError
+			}
+			props.PayloadFormatIndicator = v8
+		case PropMessageExpiryInterval:
+			v32, ok = pr.getUint32()
+			props.MessageExpiryInterval = &v32
+		case PropContentType:
+			props.ContentType, ok = pr.getString()
+		case PropResponseTopic:
+			props.ResponseTopic, ok = pr.getString()
+		case PropCorrelationData:
+			props.CorrelationData, ok = pr.getBytes()
+		case PropSubscriptionIdentifier:
+			var v uint32
+			var err Error
+			if v, err = pr.GetVarInt(); err != ErrNone {
+				return nil, err
+			}
+			if v == 0 {
+				return nil, ErrProtocolError
+			}
+			props.SubscriptionIdentifiers = append(props.SubscriptionIdentifiers, v)
+		case PropSessionExpiryInterval:
+			v32, ok = pr.getUint32()
+			props.SessionExpiryInterval = &v32
+		case PropAssignedClientIdentifier:
+			props.AssignedClientIdentifier, ok = pr.getString()
+		case PropServerKeepAlive:
+			v16, ok = pr.getUint16()
+			props.ServerKeepAlive = &v16
+		case PropAuthenticationMethod:
+			props.AuthenticationMethod, ok = pr.getString()
+		case PropAuthenticationData:
+			props.AuthenticationData, ok = pr.getBytes()
+		case PropRequestProblemInformation:
+			var b bool
+			b, ok = pr.getBool()
+			props.RequestProblemInformation = &b
+		case PropWillDelayInterval:
+			props.WillDelayInterval, ok = pr.getUint32()
+		case PropRequestResponseInformation:
+			props.RequestResponseInformation, ok = pr.getBool()
+		case PropResponseInformation:
+			props.ResponseInformation, ok = pr.getString()
+		case PropServerReference:
+			props.ServerReference, ok = pr.getString()
+		case PropReasonString:
+			props.ReasonString, ok = pr.getString()
+		case PropReceiveMaximum:
+			if props.ReceiveMaximum, ok = pr.getUint16(); ok && props.ReceiveMaximum == 0 {
+				return nil, ErrProtocolError
+			}
+		case PropTopicAliasMaximum:
+			props.TopicAliasMaximum, ok = pr.getUint16()
+		case PropTopicAlias:
+			if props.TopicAlias, ok = pr.getUint16(); ok && props.TopicAlias == 0 {
+				return nil, ErrProtocolError
+			}
+		case PropMaximumQoS:
+			if v8, ok = pr.getUint8(); ok && v8 > 1 {
+				return nil, ErrProtocolError
+			}
+			props.MaximumQoS = &v8
+		case PropRetainAvailable:
+			var b bool
+			b, ok = pr.getBool()
+			props.RetainAvailable = &b
+		case PropUserProperty:
+			var up UserProperty
+			if up.Key, ok = pr.getString(); ok {
+				up.Value, ok = pr.getString()
+			}
+			props.UserProperties = append(props.UserProperties, up)
+		case PropMaximumPacketSize:
+			if props.MaximumPacketSize, ok = pr.getUint32(); ok && props.MaximumPacketSize == 0 {
+				return nil, ErrProtocolError
+			}
+		case PropWildcardSubscriptionAvailable:
+			var b bool
+			b, ok = pr.getBool()
+			props.WildcardSubscriptionAvailable = &b
+		case PropSubscriptionIdentifierAvailable:
+			var b bool
+			b, ok = pr.getBool()
+			props.SubscriptionIdentifierAvailable = &b
+		case PropSharedSubscriptionAvailable:
+			var b bool
+			b, ok = pr.getBool()
+			props.SharedSubscriptionAvailable = &b
+		default:
+			return nil, ErrMalformedPacket
+		}
+		if !ok {
+			return nil, ErrMalformedPacket
+		}
+	}
+	return props, ErrNone
+}
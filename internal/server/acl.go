@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Authorizer decides which topics a client may publish to and subscribe on.
+type Authorizer interface {
+	CanPublish(info *ClientInfo, topic TopicName) bool
+	CanSubscribe(info *ClientInfo, filter TopicFilter) bool
+}
+
+type access int
+
+const (
+	accessRead access = 1 << iota
+	accessWrite
+)
+
+type aclRule struct {
+	access  access
+	pattern string // may contain %u and %c
+}
+
+// ACLFile is an Authorizer reading its rules from a file. Every line contains
+// one of
+//
+//	user <user name>
+//	client <client id>
+//	topic [read|write|readwrite] <topic filter>
+//
+// "topic" lines grant access to all topics matching the topic filter. In the
+// filter, "%u" is replaced by the client's user name, and "%c" by its client
+// id. Rules before the first "user" or "client" line apply to all clients;
+// all other rules only apply to the user or client id named by the preceding
+// "user" or "client" line. Everything not explicitly granted is denied.
+// Empty lines and lines starting with '#' are ignored.
+type ACLFile struct {
+	path string
+
+	lock          sync.RWMutex
+	globalRules   []aclRule
+	userRules     map[string][]aclRule
+	clientIdRules map[string][]aclRule
+}
+
+func NewACLFile(path string) (*ACLFile, error) {
+	a := &ACLFile{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload re-reads the ACL file.
+func (a *ACLFile) Reload() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var globalRules []aclRule
+	userRules := make(map[string][]aclRule)
+	clientIdRules := make(map[string][]aclRule)
+	var section map[string][]aclRule // nil for global rules
+	var sectionName string
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "user", "client":
+			if len(fields) != 2 {
+				return fmt.Errorf("%s:%d: expected \"%s <name>\"", a.path, lineNo, fields[0])
+			}
+			section = userRules
+			if fields[0] == "client" {
+				section = clientIdRules
+			}
+			sectionName = fields[1]
+		case "topic":
+			rule := aclRule{access: accessRead | accessWrite}
+			switch len(fields) {
+			case 2:
+				rule.pattern = fields[1]
+			case 3:
+				switch fields[1] {
+				case "read":
+					rule.access = accessRead
+				case "write":
+					rule.access = accessWrite
+				case "readwrite":
+				default:
+					return fmt.Errorf("%s:%d: unknown access %q", a.path, lineNo, fields[1])
+				}
+				rule.pattern = fields[2]
+			default:
+				return fmt.Errorf("%s:%d: expected \"topic [read|write|readwrite] <filter>\"", a.path, lineNo)
+			}
+			if section == nil {
+				globalRules = append(globalRules, rule)
+			} else {
+				section[sectionName] = append(section[sectionName], rule)
+			}
+		default:
+			return fmt.Errorf("%s:%d: unknown keyword %q", a.path, lineNo, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	a.globalRules = globalRules
+	a.userRules = userRules
+	a.clientIdRules = clientIdRules
+	a.lock.Unlock()
+	return nil
+}
+
+// filter returns the rule's topic filter for the given client. Returns false
+// if the rule can't apply to the client because the substituted user name or
+// client id contains characters with a special meaning in topic filters.
+func (r *aclRule) filter(info *ClientInfo) (TopicFilter, bool) {
+	if !strings.Contains(r.pattern, "%") {
+		return TopicFilter(r.pattern), true
+	}
+	for _, v := range []string{info.Username, info.ClientId} {
+		if strings.ContainsAny(v, "/+#") {
+			return "", false
+		}
+	}
+	if strings.Contains(r.pattern, "%u") && !info.HasUsername {
+		return "", false
+	}
+	p := strings.Replace(r.pattern, "%u", info.Username, -1)
+	p = strings.Replace(p, "%c", info.ClientId, -1)
+	return TopicFilter(p), true
+}
+
+// allowed returns whether any rule applying to the client grants access and
+// accepts the client's topic.
+func (a *ACLFile) allowed(info *ClientInfo, acc access, accepts func(f TopicFilter) bool) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	ruleSets := [][]aclRule{a.globalRules, a.clientIdRules[info.ClientId]}
+	if info.HasUsername {
+		ruleSets = append(ruleSets, a.userRules[info.Username])
+	}
+	for _, rules := range ruleSets {
+		for _, rule := range rules {
+			if rule.access&acc == 0 {
+				continue
+			}
+			if f, ok := rule.filter(info); ok && accepts(f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *ACLFile) CanPublish(info *ClientInfo, topic TopicName) bool {
+	return a.allowed(info, accessWrite, func(f TopicFilter) bool { return f.matches(topic) })
+}
+
+func (a *ACLFile) CanSubscribe(info *ClientInfo, filter TopicFilter) bool {
+	return a.allowed(info, accessRead, func(f TopicFilter) bool { return f.covers(filter) })
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"container/list"
+	"sync"
+)
+
+// topicAliases assigns the topic aliases the server uses when sending
+// PUBLISH messages to a MQTT 5 client [MQTT5-3.3.2.3.4]. If all aliases
+// allowed by the client are taken, the least recently used one is reassigned.
+type topicAliases struct {
+	// Held while a message using an alias is encoded and sent, so the client
+	// always learns an alias before it is used.
+	lock sync.Mutex
+
+	maximum uint16
+	aliases map[TopicName]*list.Element // values are *topicAlias
+	lru     *list.List                  // most recently used first
+}
+
+type topicAlias struct {
+	topic TopicName
+	alias uint16
+}
+
+func newTopicAliases(maximum uint16) *topicAliases {
+	return &topicAliases{
+		maximum: maximum,
+		aliases: make(map[TopicName]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the alias for topic. known is true if the alias was sent to the
+// client before, and the topic name can be omitted. Must be called with
+// a.lock held.
+func (a *topicAliases) get(topic TopicName) (alias uint16, known bool) {
+	if e, ok := a.aliases[topic]; ok {
+		a.lru.MoveToFront(e)
+		return e.Value.(*topicAlias).alias, true
+	}
+	if a.lru.Len() < int(a.maximum) {
+		ta := &topicAlias{topic, uint16(a.lru.Len() + 1)}
+		a.aliases[topic] = a.lru.PushFront(ta)
+		return ta.alias, false
+	}
+	e := a.lru.Back()
+	ta := e.Value.(*topicAlias)
+	delete(a.aliases, ta.topic)
+	ta.topic = topic
+	a.aliases[topic] = e
+	a.lru.MoveToFront(e)
+	return ta.alias, false
+}
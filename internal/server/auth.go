@@ -0,0 +1,253 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// CONNACK return codes
+const (
+	ConnAccepted                           byte = 0x00
+	ConnRefusedUnacceptableProtocolVersion byte = 0x01
+	ConnRefusedIdentifierRejected          byte = 0x02
+	ConnRefusedServerUnavailable           byte = 0x03
+	ConnRefusedBadUsernameOrPassword       byte = 0x04
+	ConnRefusedNotAuthorized               byte = 0x05
+)
+
+// ClientInfo describes a connecting client.
+type ClientInfo struct {
+	ClientId    string
+	HasUsername bool
+	Username    string
+	HasPassword bool
+	Password    []byte
+	RemoteAddr  net.Addr
+	// Credentials of the connecting process for Unix domain socket
+	// connections, nil otherwise.
+	PeerCredentials *PeerCredentials
+}
+
+// Authenticator decides whether a client is allowed to connect.
+type Authenticator interface {
+	// Authenticate returns ConnAccepted if the client is allowed to connect,
+	// or the CONNACK return code to refuse the connection with, usually
+	// ConnRefusedBadUsernameOrPassword or ConnRefusedNotAuthorized.
+	Authenticate(info *ClientInfo) byte
+}
+
+// AuthMethod is an MQTT 5 enhanced authentication method [MQTT5-4.12].
+// Clients choose a method by name in CONNECT, see Config.AuthMethods.
+type AuthMethod interface {
+	// Start begins an authentication exchange with a client, either when
+	// it connects or when it re-authenticates.
+	Start(info *ClientInfo) AuthExchange
+}
+
+// AuthExchange is a single challenge/response exchange of an AuthMethod.
+type AuthExchange interface {
+	// Next processes authentication data from the client and returns the
+	// data to send back. done is true once the client is authenticated;
+	// the exchange then sets the user name in the ClientInfo passed to
+	// Start. An error means that authentication failed.
+	Next(data []byte) (response []byte, done bool, err error)
+}
+
+// PasswordFileAuthenticator authenticates clients against a password file.
+// Every line of the file contains a user name and a password hash separated
+// by a colon. Empty lines and lines starting with '#' are ignored. Supported
+// hashes are bcrypt (e.g. created with "htpasswd -nB <user>"), argon2i or
+// argon2id in PHC string format ("$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>"),
+// and SCRAM-SHA-256 in PostgreSQL's format
+// ("SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>"). Users with
+// SCRAM-SHA-256 hashes can also use enhanced authentication, see
+// NewScramSHA256.
+type PasswordFileAuthenticator struct {
+	path           string
+	allowAnonymous bool
+
+	lock  sync.RWMutex
+	users map[string]string
+}
+
+// NewPasswordFileAuthenticator reads the password file at path. If
+// allowAnonymous is true, clients that don't provide a user name are
+// accepted.
+func NewPasswordFileAuthenticator(path string, allowAnonymous bool) (*PasswordFileAuthenticator, error) {
+	a := &PasswordFileAuthenticator{
+		path:           path,
+		allowAnonymous: allowAnonymous,
+	}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload re-reads the password file.
+func (a *PasswordFileAuthenticator) Reload() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return fmt.Errorf("%s:%d: missing ':'", a.path, lineNo)
+		}
+		user, hash := line[:i], line[i+1:]
+		if strings.HasPrefix(hash, scramPrefix) {
+			if _, err := parseScramCredentials(hash); err != nil {
+				return fmt.Errorf("%s:%d: %s", a.path, lineNo, err)
+			}
+		} else if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "$argon2") {
+			return fmt.Errorf("%s:%d: unsupported hash for user %s", a.path, lineNo, user)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	a.users = users
+	a.lock.Unlock()
+	logger.Infof("Loaded %d users from %s", len(users), a.path)
+	return nil
+}
+
+func (a *PasswordFileAuthenticator) Authenticate(info *ClientInfo) byte {
+	if !info.HasUsername {
+		if a.allowAnonymous {
+			return ConnAccepted
+		}
+		return ConnRefusedNotAuthorized
+	}
+	a.lock.RLock()
+	hash, ok := a.users[info.Username]
+	a.lock.RUnlock()
+	if !ok || !info.HasPassword {
+		return ConnRefusedBadUsernameOrPassword
+	}
+	match, err := verifyPassword(hash, info.Password)
+	if err != nil {
+		logger.Warningf("Can't verify password of user %s: %s", info.Username, err)
+		return ConnRefusedBadUsernameOrPassword
+	}
+	if !match {
+		return ConnRefusedBadUsernameOrPassword
+	}
+	return ConnAccepted
+}
+
+// ScramCredentials returns the SCRAM-SHA-256 credentials of username, if
+// the password file has them.
+func (a *PasswordFileAuthenticator) ScramCredentials(username string) *ScramCredentials {
+	a.lock.RLock()
+	hash, ok := a.users[username]
+	a.lock.RUnlock()
+	if !ok || !strings.HasPrefix(hash, scramPrefix) {
+		return nil
+	}
+	creds, err := parseScramCredentials(hash)
+	if err != nil {
+		logger.Warningf("Can't parse SCRAM credentials of user %s: %s", username, err)
+		return nil
+	}
+	return creds
+}
+
+func verifyPassword(hash string, password []byte) (bool, error) {
+	if strings.HasPrefix(hash, "$argon2") {
+		return verifyArgon2(hash, password)
+	}
+	if strings.HasPrefix(hash, scramPrefix) {
+		creds, err := parseScramCredentials(hash)
+		if err != nil {
+			return false, err
+		}
+		return creds.verify(password), nil
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), password)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// verifyArgon2 verifies password against a hash in PHC string format, e.g.
+// "$argon2id$v=19$m=65536,t=3,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG".
+func verifyArgon2(hash string, password []byte) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, fmt.Errorf("malformed argon2 hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, fmt.Errorf("malformed argon2 version: %s", err)
+	}
+	if version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, fmt.Errorf("malformed argon2 parameters: %s", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("malformed argon2 salt: %s", err)
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("malformed argon2 hash: %s", err)
+	}
+
+	var got []byte
+	switch parts[1] {
+	case "argon2id":
+		got = argon2.IDKey(password, salt, time, memory, threads, uint32(len(want)))
+	case "argon2i":
+		got = argon2.Key(password, salt, time, memory, threads, uint32(len(want)))
+	default:
+		return false, fmt.Errorf("unsupported argon2 variant %s", parts[1])
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
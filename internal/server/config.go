@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// OverflowPolicy determines what happens when a message needs to be queued
+// for a session whose queue is already full.
+type OverflowPolicy int
+
+const (
+	// DropOldest removes the oldest queued message to make room for the new one.
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the new message.
+	DropNewest
+	// Disconnect discards the whole persistent session, and disconnects the
+	// client if it is connected. The client will get a clean session when it
+	// connects again.
+	Disconnect
+)
+
+var overflowPolicyNames = map[string]OverflowPolicy{
+	"drop-oldest": DropOldest,
+	"drop-newest": DropNewest,
+	"disconnect":  Disconnect,
+}
+
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	if p, ok := overflowPolicyNames[s]; ok {
+		return p, nil
+	}
+	return DropOldest, fmt.Errorf("unknown overflow policy %q", s)
+}
+
+// ShareStrategy determines which member of a shared subscription group
+// receives a message.
+type ShareStrategy int
+
+const (
+	// RoundRobin sends messages to the members in turn.
+	RoundRobin ShareStrategy = iota
+	// LeastInflight sends messages to the member with the fewest
+	// unacknowledged and queued messages.
+	LeastInflight
+)
+
+var shareStrategyNames = map[string]ShareStrategy{
+	"round-robin":    RoundRobin,
+	"least-inflight": LeastInflight,
+}
+
+func ParseShareStrategy(s string) (ShareStrategy, error) {
+	if p, ok := shareStrategyNames[s]; ok {
+		return p, nil
+	}
+	return RoundRobin, fmt.Errorf("unknown shared subscription strategy %q", s)
+}
+
+type Config struct {
+	// Where the server accepts connections. All listeners share the same
+	// topics and sessions.
+	Listeners []*ListenerConfig
+
+	// Maximum number of messages queued for an offline persistent session,
+	// or for a connected client that has reached its receive maximum. 0
+	// means unlimited.
+	MaxQueuedMessages int
+	// What to do if MaxQueuedMessages is exceeded.
+	QueueOverflowPolicy OverflowPolicy
+
+	// Maximum number of unacknowledged QoS 1 and 2 messages sent to MQTT
+	// 3.1 and 3.1.1 clients; further messages wait in the session's queue.
+	// MQTT 5 clients set their own receive maximum. 0 means no limit.
+	ReceiveMaximum int
+
+	// How long messages from MQTT 3.1 and 3.1.1 clients, which can't set a
+	// message expiry interval, are kept for offline sessions and as retained
+	// messages. 0 means they don't expire.
+	DefaultMessageTTL time.Duration
+
+	// How long persistent sessions of MQTT 3.1 and 3.1.1 clients are kept
+	// after the client disconnected. MQTT 5 clients choose this themselves
+	// with the session expiry interval. 0 means they are kept forever.
+	DefaultSessionExpiry time.Duration
+
+	// Size in bytes of the largest packet clients may send. Connections
+	// sending larger packets are closed. 0 means the protocol's limit of
+	// 256 MB.
+	MaximumPacketSize uint32
+
+	// Number of topic aliases MQTT 5 clients may use when publishing. 0
+	// means clients may not use topic aliases.
+	TopicAliasMaximum uint16
+
+	// How messages are distributed among the members of a shared
+	// subscription group.
+	SharedSubscriptionStrategy ShareStrategy
+
+	// Decides which clients may connect. If nil, all clients are accepted.
+	Authenticator Authenticator
+
+	// MQTT 5 enhanced authentication methods, keyed by name. Clients that
+	// choose one of them in CONNECT are authenticated by it instead of by
+	// the Authenticator. Not offered on listeners with their own
+	// Authenticator, see ListenerConfig.AuthMethods.
+	AuthMethods map[string]AuthMethod
+
+	// Decides which topics clients may publish to and subscribe on. If nil,
+	// all clients may access all topics.
+	Authorizer Authorizer
+
+	// Where to persist sessions with cleanSession == 0. If nil, sessions are
+	// only kept in memory, in the server's own session state; unlike with a
+	// MemoryStore, there is no second copy of them.
+	SessionStore Store
+
+	// Where to persist retained messages. If nil, retained messages are
+	// only kept in memory.
+	RetainedStore RetainedStore
+}
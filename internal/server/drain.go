@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"github.com/asig/mqttlite/internal/messages"
+)
+
+// Drain moves all clients to another server, e.g. before this one is shut
+// down for maintenance. Connected MQTT 5 clients are sent a DISCONNECT with
+// reason code Use Another Server, or Server Moved if permanent is true, and
+// serverReference, which may be empty [MQTT5-4.11]. Older clients are just
+// disconnected. Clients that connect later are refused with the same reason
+// code and server reference until the server is restarted.
+func (s *Server) Drain(serverReference string, permanent bool) {
+	reasonCode := ReasonUseAnotherServer
+	if permanent {
+		reasonCode = ReasonServerMoved
+	}
+	s.sessionsLock.Lock()
+	s.drainReasonCode = reasonCode
+	s.drainReference = serverReference
+	var connected []*Session
+	for _, sess := range s.clients {
+		connected = append(connected, sess)
+	}
+	s.sessionsLock.Unlock()
+
+	logger.Infof("Draining server, redirecting %d clients to %q", len(connected), serverReference)
+	for _, sess := range connected {
+		sess.disconnectWithProperties(reasonCode, &messages.Properties{
+			ServerReference: serverReference,
+			ReasonString:    "Server is draining",
+		})
+	}
+}
+
+// draining returns the reason code and server reference to refuse new
+// clients with, or 0 if the server isn't draining.
+func (s *Server) draining() (byte, string) {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	return s.drainReasonCode, s.drainReference
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"time"
+
+	"github.com/asig/mqttlite/internal/messages"
+)
+
+// authenticateConnect runs the enhanced authentication exchange that the
+// client started in CONNECT, reading AUTH packets until the method is done
+// [MQTT5-4.12.0-2]. Returns the authentication data for the CONNACK, or
+// false if the client was refused and the connection closed.
+func (s *Session) authenticateConnect(info *ClientInfo, data []byte) ([]byte, bool) {
+	exchange := s.authMethods()[s.authMethod].Start(info)
+	maxSize := int(s.server.config.MaximumPacketSize)
+	for {
+		response, done, err := exchange.Next(data)
+		if err != nil {
+			logger.Infof("Session %d: Authentication of client %s failed: %s", s.id, info.ClientId, err)
+			s.sendConnAck(ReasonNotAuthorized, false, nil)
+			s.Close()
+			return nil, false
+		}
+		if done {
+			return response, true
+		}
+		s.sendAuth(ReasonContinueAuthentication, response)
+
+		msg, readErr := messages.ReadMessageWithTimeout(s.conn, 30*time.Second, maxSize)
+		if readErr == messages.ErrPacketTooLarge {
+			logger.Infof("Session %d: AUTH exceeds maximum packet size, closing connection", s.id)
+			s.sendConnAck(ReasonPacketTooLarge, false, nil)
+			s.Close()
+			return nil, false
+		}
+		if readErr != messages.ErrNone {
+			logger.Infof("Session %d: No AUTH received, closing connection", s.id)
+			s.Close()
+			return nil, false
+		}
+		if msg.Type != messages.Auth { // [MQTT5-4.12.0-4]
+			logger.Infof("Session %d: Expected AUTH, got %d, closing connection", s.id, msg.Type)
+			s.sendConnAck(ReasonProtocolError, false, nil)
+			s.Close()
+			return nil, false
+		}
+		var reasonCode, refuse byte
+		reasonCode, data, refuse = s.readAuth(msg)
+		if refuse == ReasonSuccess && reasonCode != ReasonContinueAuthentication {
+			refuse = ReasonProtocolError
+		}
+		if refuse != ReasonSuccess {
+			s.sendConnAck(refuse, false, nil)
+			s.Close()
+			return nil, false
+		}
+	}
+}
+
+// readAuth decodes an AUTH packet and returns its reason code and
+// authentication data. If the packet is invalid, refuse is the reason code
+// to reject it with, otherwise ReasonSuccess.
+func (s *Session) readAuth(msg *messages.Message) (reasonCode byte, data []byte, refuse byte) {
+	if msg.Flags != 0 { // [MQTT5-3.15.1-1]
+		logger.Warningf("Invalid flags %d in AUTH", msg.Flags)
+		return 0, nil, ReasonMalformedPacket
+	}
+	if len(msg.Data) == 0 {
+		// Reason code Success without properties, so the authentication
+		// method is missing [MQTT5-3.15.2.1].
+		return ReasonSuccess, nil, ReasonProtocolError
+	}
+	pr := msg.PayloadReader(0)
+	reasonCode = pr.GetUint8()
+	props, err := pr.GetProperties()
+	if err != messages.ErrNone {
+		logger.Warningf("Invalid properties in AUTH")
+		return 0, nil, reasonCodeForError(err)
+	}
+	if props.AuthenticationMethod != s.authMethod { // [MQTT5-4.12.0-5]
+		logger.Warningf("AUTH with authentication method %q instead of %q", props.AuthenticationMethod, s.authMethod)
+		return 0, nil, ReasonProtocolError
+	}
+	logger.Infof("Session %d: <-- AUTH 0x%02x", s.id, reasonCode)
+	return reasonCode, props.AuthenticationData, ReasonSuccess
+}
+
+func (s *Session) sendAuth(reasonCode byte, data []byte) {
+	logger.Infof("Session %d: --> AUTH 0x%02x", s.id, reasonCode)
+	msg := &messages.Message{Type: messages.Auth, Flags: 0, Data: []byte{reasonCode}}
+	msg.PayloadWriter().WriteProperties(&messages.Properties{
+		AuthenticationMethod: s.authMethod,
+		AuthenticationData:   data,
+	})
+	msg.Send(s.conn)
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"time"
+
+	"github.com/asig/mqttlite/internal/messages"
+)
+
+// messageExpiry returns when a message published by the client expires.
+// MQTT 5 clients set the expiry with props; messages from older clients get
+// the server's default TTL. Returns the zero time if the message does not
+// expire.
+func (s *Session) messageExpiry(props *messages.Properties) time.Time {
+	if s.isV5() {
+		if props != nil && props.MessageExpiryInterval != nil { // [MQTT5-3.3.2-5]
+			return time.Now().Add(time.Duration(*props.MessageExpiryInterval) * time.Second)
+		}
+		return time.Time{}
+	}
+	if ttl := s.server.config.DefaultMessageTTL; ttl > 0 {
+		return time.Now().Add(ttl)
+	}
+	return time.Time{}
+}
+
+// expired returns whether the message must not be delivered anymore.
+func (dm *outstandingPublishMessage) expired(now time.Time) bool {
+	return !dm.expiresAt.IsZero() && !now.Before(dm.expiresAt)
+}
+
+// remainingLifetime returns the number of seconds until the message
+// expires, rounded up.
+func (dm *outstandingPublishMessage) remainingLifetime() uint32 {
+	remaining := time.Until(dm.expiresAt)
+	if remaining <= 0 {
+		return 0
+	}
+	return uint32((remaining + time.Second - 1) / time.Second)
+}
+
+// unixTime converts t to the representation used in stores: seconds since
+// the epoch, or 0 for the zero time.
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// fromUnixTime is the inverse of unixTime.
+func fromUnixTime(secs int64) time.Time {
+	if secs == 0 {
+		return time.Time{}
+	}
+	return time.Unix(secs, 0)
+}
+
+// dropExpiredPublishes removes expired messages that were sent to the client,
+// but not acknowledged yet, so they are not sent again. Must be called with
+// s.lock held.
+func (s *sessionState) dropExpiredPublishes(now time.Time) {
+	for packetId, msg := range s.unacknowledgedPublishes {
+		if msg.expired(now) {
+			logger.Infof("Client %s: PUBLISH(%d) expired", s.clientId, packetId)
+			delete(s.unacknowledgedPublishes, packetId)
+			s.persist(func(store Store) error { return store.DeletePublish(s.clientId, packetId) })
+		}
+	}
+}
+
+// dropExpiredQueued removes expired messages from the front of the offline
+// queue. Expired messages further back are skipped when the client
+// reconnects. Must be called with s.lock held.
+func (s *sessionState) dropExpiredQueued(now time.Time) {
+	n := 0
+	for n < len(s.queuedMessages) && s.queuedMessages[n].expired(now) {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	logger.Infof("Client %s: %d queued messages expired", s.clientId, n)
+	s.queuedMessages = s.queuedMessages[n:]
+	s.persist(func(store Store) error { return store.Dequeue(s.clientId, n) })
+}
+
+// expireRetained removes the expired retained message of topic. Must be
+// called with s.topicsLock held.
+func (s *Server) expireRetained(topic *Topic) {
+	logger.Infof("Retained message for %s expired", topic.name)
+	topic.retainedMessage = nil
+	if s.config.RetainedStore != nil {
+		if err := s.config.RetainedStore.Delete(topic.name); err != nil {
+			logger.Warningf("Can't delete retained message for %s: %s", topic.name, err)
+		}
+	}
+}
+
+// purgeExpired removes expired retained messages, and expired messages of
+// offline sessions. Connected sessions drop their expired messages when
+// they would resend them.
+func (s *Server) purgeExpired() {
+	now := time.Now()
+	s.topicsLock.Lock()
+	for _, topic := range s.topics {
+		if topic.retainedMessage != nil && topic.retainedMessage.expired(now) {
+			s.expireRetained(topic)
+		}
+	}
+	s.topicsLock.Unlock()
+
+	for _, state := range s.sessionStates() {
+		state.lock.Lock()
+		if state.session == nil {
+			state.dropExpiredQueued(now)
+			state.dropExpiredPublishes(now)
+		}
+		state.lock.Unlock()
+	}
+}
+
+// sessionNeverExpires is the session expiry interval of sessions that are
+// kept forever [MQTT5-3.1.2.11.2].
+const sessionNeverExpires = 0xFFFFFFFF
+
+// defaultSessionExpiryInterval returns the session expiry interval in
+// seconds for persistent sessions of MQTT 3.1 and 3.1.1 clients.
+func (s *Server) defaultSessionExpiryInterval() uint32 {
+	d := s.config.DefaultSessionExpiry
+	switch {
+	case d <= 0 || d/time.Second >= sessionNeverExpires:
+		return sessionNeverExpires
+	case d < time.Second:
+		return 1
+	}
+	return uint32(d / time.Second)
+}
+
+// setExpiryInterval sets the session expiry interval in seconds. With an
+// interval of 0, the session ends when the connection is closed.
+func (s *Session) setExpiryInterval(interval uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expiryInterval = interval
+	s.cleanSession = interval == 0
+	s.persist(func(store Store) error { return store.SetSessionExpiry(s.clientId, interval) })
+}
+
+// startExpiry starts the session expiry timer of a session whose client
+// disconnected. Must be called with s.lock held.
+func (s *sessionState) startExpiry(now time.Time) {
+	if s.expiryInterval == sessionNeverExpires {
+		s.expiresAt = time.Time{}
+		return
+	}
+	s.expiresAt = now.Add(time.Duration(s.expiryInterval) * time.Second)
+}
+
+// expireSession discards the state of an offline persistent session if its
+// session expiry interval has passed [MQTT5-3.1.2-23]. Its delayed will is
+// published, and messages it received through shared subscriptions are
+// handed to the other members of the groups.
+func (s *Server) expireSession(state *sessionState, now time.Time) {
+	s.sessionsLock.Lock()
+	state.lock.Lock()
+	expired := s.persistentSessions[state.clientId] == state && state.session == nil &&
+		!state.expiresAt.IsZero() && !now.Before(state.expiresAt)
+	if expired {
+		delete(s.persistentSessions, state.clientId)
+		state.store = nil
+	}
+	state.lock.Unlock()
+	s.sessionsLock.Unlock()
+	if !expired {
+		return
+	}
+	logger.Infof("Session of client %s expired", state.clientId)
+	if s.store != nil {
+		if err := s.store.DeleteSession(state.clientId); err != nil {
+			logger.Warningf("Client %s: Can't delete session from store: %s", state.clientId, err)
+		}
+	}
+	state.publishDelayedWill()
+	s.redistributeShared(state)
+}
+
+// expireSessions discards the state of all offline sessions whose session
+// expiry interval has passed.
+func (s *Server) expireSessions() {
+	now := time.Now()
+	s.sessionsLock.Lock()
+	states := make([]*sessionState, 0, len(s.persistentSessions))
+	for _, state := range s.persistentSessions {
+		states = append(states, state)
+	}
+	s.sessionsLock.Unlock()
+	for _, state := range states {
+		s.expireSession(state, now)
+	}
+}
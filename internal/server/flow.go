@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"time"
+)
+
+// inflightFull returns whether the client's receive maximum is reached: it
+// must not get more QoS 1 and 2 messages until it acknowledges some
+// [MQTT5-4.9.0-2]. QoS 2 messages count until the PUBCOMP arrives. Must be
+// called with s.lock held.
+func (s *Session) inflightFull() bool {
+	inflight := len(s.unacknowledgedPublishes) + len(s.unacknowledgedPubRels)
+	return s.receiveMaximum > 0 && inflight >= s.receiveMaximum
+}
+
+// addInflight assigns a packet id to msg and tracks it until it is
+// acknowledged. Must be called with s.lock held.
+func (s *Session) addInflight(msg *outstandingPublishMessage) {
+	msg.packetId = s.nextFreePacketId()
+	msg.nextSendTime = time.Now().Add(10 * time.Second)
+	msg.sendCount = 1
+	s.unacknowledgedPublishes[msg.packetId] = msg
+	s.persist(func(store Store) error { return store.StorePublish(s.clientId, msg.toStoredMessage()) })
+}
+
+// sendQueued sends queued messages until the queue is empty or the client's
+// receive maximum is reached. It is called whenever the client acknowledges
+// a message.
+func (s *Session) sendQueued() {
+	now := time.Now()
+	var send []*outstandingPublishMessage
+	s.lock.Lock()
+	n := 0
+	for n < len(s.queuedMessages) && !s.inflightFull() {
+		msg := s.queuedMessages[n]
+		n++
+		if msg.expired(now) {
+			logger.Infof("Session %d: Queued message for %s expired", s.id, msg.topic)
+			continue
+		}
+		if s.tooLarge(msg) {
+			logger.Infof("Session %d: Queued message for %s exceeds the client's maximum packet size, dropping it", s.id, msg.topic)
+			continue
+		}
+		s.addInflight(msg)
+		send = append(send, msg)
+	}
+	if n > 0 {
+		s.queuedMessages = s.queuedMessages[n:]
+		s.persist(func(store Store) error { return store.Dequeue(s.clientId, n) })
+	}
+	s.lock.Unlock()
+	for _, msg := range send {
+		logger.Infof("Session %d: --> PUBLISH %#v", s.id, msg)
+		s.writePublish(msg)
+	}
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// journal is an append-only log of JSON records, one per line. It is used by
+// the file based stores: every change is appended as a record, and the log is
+// compacted from time to time by replacing it with a snapshot of the current
+// state.
+type journal struct {
+	path string
+
+	lock    sync.Mutex
+	file    *os.File
+	records int // number of records in the log
+}
+
+// openJournal opens the journal at path, creating it if necessary. replay is
+// called for every record in the log. Anything after the last good record is
+// cut off, so that new records don't get appended to a partially written one.
+func openJournal(path string, replay func(data []byte) error) (*journal, error) {
+	j := &journal{path: path}
+	// Offset after the last line read, and after the last good record.
+	var offset, end int64
+	// Whether the last line read, and the last good record, end with a
+	// newline.
+	newline, terminated := false, true
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 512*1024*1024)
+		scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+			advance, token, err := bufio.ScanLines(data, atEOF)
+			offset += int64(advance)
+			newline = advance > 0 && data[advance-1] == '\n'
+			return advance, token, err
+		})
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+			if err := replay(line); err != nil {
+				// Most likely, the server died while writing the last record.
+				logger.Warningf("%s: Ignoring bad record %d: %s", path, j.records+1, err)
+				continue
+			}
+			j.records++
+			end, terminated = offset, newline
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if offset > end {
+		logger.Warningf("%s: Truncating to the last good record", path)
+		err = f.Truncate(end)
+	}
+	if err == nil && !terminated {
+		_, err = f.Write([]byte{'\n'})
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	j.file = f
+	return j, nil
+}
+
+func encodeRecord(record interface{}) ([]byte, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func decodeRecord(data []byte, record interface{}) error {
+	return json.Unmarshal(data, record)
+}
+
+// append writes record to the end of the log.
+func (j *journal) append(record interface{}) error {
+	data, err := encodeRecord(record)
+	if err != nil {
+		return err
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if _, err := j.file.Write(data); err != nil {
+		return err
+	}
+	j.records++
+	return nil
+}
+
+// size returns the number of records in the log.
+func (j *journal) size() int {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.records
+}
+
+// compact replaces the log with the records written by snapshot. The new log
+// is written to a temporary file first, so that a crash during compaction
+// leaves the old log intact.
+func (j *journal) compact(snapshot func(write func(record interface{}) error) error) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	records := 0
+	err = snapshot(func(record interface{}) error {
+		data, err := encodeRecord(record)
+		if err != nil {
+			return err
+		}
+		records++
+		_, err = w.Write(data)
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, j.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	j.file.Close()
+	j.file = f
+	j.records = records
+	return nil
+}
+
+func (j *journal) close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.file.Close()
+}
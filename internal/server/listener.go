@@ -0,0 +1,169 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+)
+
+type ListenerType int
+
+const (
+	TCPListener ListenerType = iota
+	WebSocketListener
+	UnixListener
+)
+
+var listenerTypeNames = map[string]ListenerType{
+	"tcp":  TCPListener,
+	"ws":   WebSocketListener,
+	"unix": UnixListener,
+}
+
+type ListenerConfig struct {
+	Type ListenerType
+	// Address to listen on, e.g. "localhost:1883", or the socket's path for
+	// Unix listeners.
+	Address string
+	// If set, connections are encrypted with TLS.
+	TLS *TLSConfig
+	// Options for WebSocket listeners. May be nil.
+	WebSocket *WebSocketConfig
+	// Options for Unix listeners. May be nil.
+	Unix *UnixSocketConfig
+
+	// If true, connections must start with a PROXY protocol v1 or v2 header,
+	// and the client address from the header is used instead of the
+	// proxy's.
+	ProxyProtocol bool
+
+	// Maximum number of concurrent connections. 0 means unlimited.
+	MaxConnections int
+	// Maximum number of concurrent connections from the same IP address.
+	// 0 means unlimited.
+	MaxConnectionsPerHost int
+
+	// If set, used instead of the server's Authenticator and Authorizer for
+	// clients connecting through this listener.
+	Authenticator Authenticator
+	Authorizer    Authorizer
+	// Enhanced authentication methods of this listener. If nil, the
+	// server's AuthMethods are used, unless Authenticator is set.
+	AuthMethods map[string]AuthMethod
+}
+
+func (c *ListenerConfig) String() string {
+	for name, t := range listenerTypeNames {
+		if t == c.Type {
+			if c.TLS != nil {
+				return fmt.Sprintf("%s+tls %s", name, c.Address)
+			}
+			return fmt.Sprintf("%s %s", name, c.Address)
+		}
+	}
+	return c.Address
+}
+
+// listener accepts connections according to a ListenerConfig.
+type listener struct {
+	net.Listener
+	config    *ListenerConfig
+	tlsLoader *tlsConfigLoader
+
+	lock sync.Mutex
+	// Number of open connections, in total and per host
+	connections     int
+	hostConnections map[string]int
+}
+
+func newListener(config *ListenerConfig) (*listener, error) {
+	l := &listener{config: config}
+	if config.TLS != nil {
+		loader, err := newTLSConfigLoader(config.TLS)
+		if err != nil {
+			return nil, err
+		}
+		l.tlsLoader = loader
+	}
+
+	var netListener net.Listener
+	var err error
+	if config.Type == UnixListener {
+		netListener, err = listenUnix(config.Address, config.Unix)
+	} else {
+		netListener, err = net.Listen("tcp", config.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config.ProxyProtocol {
+		netListener = &proxyProtocolListener{netListener}
+	}
+	if l.tlsLoader != nil {
+		netListener = tls.NewListener(netListener, l.tlsLoader.serverConfig())
+	}
+	if config.Type == WebSocketListener {
+		wsConfig := config.WebSocket
+		if wsConfig == nil {
+			wsConfig = &WebSocketConfig{}
+		}
+		netListener = newWebSocketListener(wsConfig, netListener)
+	}
+	l.Listener = netListener
+	return l, nil
+}
+
+// acquire reserves a connection slot for a client on host. Returns false if
+// one of the listener's connection limits is reached.
+func (l *listener) acquire(host string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.config.MaxConnections > 0 && l.connections >= l.config.MaxConnections {
+		return false
+	}
+	if l.config.MaxConnectionsPerHost > 0 && l.hostConnections[host] >= l.config.MaxConnectionsPerHost {
+		return false
+	}
+	if l.hostConnections == nil {
+		l.hostConnections = make(map[string]int)
+	}
+	l.connections++
+	l.hostConnections[host]++
+	return true
+}
+
+func (l *listener) release(host string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.connections--
+	if l.hostConnections[host]--; l.hostConnections[host] == 0 {
+		delete(l.hostConnections, host)
+	}
+}
+
+// hostOf returns the host part of addr, e.g. the IP address of TCP clients.
+func hostOf(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
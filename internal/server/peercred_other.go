@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerCredentials returns the credentials of the process connected to conn.
+// Only supported on Linux.
+func peerCredentials(conn *net.UnixConn) (*PeerCredentials, error) {
+	return nil, fmt.Errorf("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a client may take to send the PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+var proxyV2Signature = []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+// proxyProtocolListener expects every accepted connection to start with a
+// PROXY protocol (v1 or v2) header, as sent by HAProxy and other load
+// balancers, and reports the address from the header as the connection's
+// remote address.
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolConn reads the PROXY protocol header on first use, so that a
+// slow client doesn't block the listener's Accept.
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+
+	deadlineLock sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remoteAddr, c.err = readProxyHeader(c.reader)
+		c.deadlineLock.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.deadlineLock.Unlock()
+		if c.err != nil {
+			logger.Warningf("Invalid PROXY protocol header from %s: %s", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client's address from the PROXY protocol header.
+// If the header didn't contain an address, the address of the proxy is
+// returned.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header. Returns nil if the
+// header doesn't carry an address, e.g. for health checks from the proxy.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	return nil, fmt.Errorf("no PROXY protocol header")
+}
+
+// readProxyHeaderV1 reads a header like "PROXY TCP4 <src> <dst> <srcport> <dstport>\r\n".
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// The header is at most 107 bytes long
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("v1 header too long")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed v1 source address %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads a binary header. TLVs are ignored.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+	command := header[12] & 0xf
+	family := header[13]
+	data := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	switch command {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", command)
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(data) < 12 {
+			return nil, fmt.Errorf("v2 address block too short")
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:4]), Port: int(binary.BigEndian.Uint16(data[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(data) < 36 {
+			return nil, fmt.Errorf("v2 address block too short")
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:16]), Port: int(binary.BigEndian.Uint16(data[32:34]))}, nil
+	}
+	// UNSPEC, UDP, and Unix sockets don't carry a usable client address
+	return nil, nil
+}
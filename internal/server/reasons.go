@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"github.com/asig/mqttlite/internal/messages"
+)
+
+// MQTT 5 reason codes
+const (
+	ReasonSuccess                             byte = 0x00
+	ReasonGrantedQoS1                         byte = 0x01
+	ReasonGrantedQoS2                         byte = 0x02
+	ReasonDisconnectWithWill                  byte = 0x04
+	ReasonNoMatchingSubscribers               byte = 0x10
+	ReasonNoSubscriptionExisted               byte = 0x11
+	ReasonContinueAuthentication              byte = 0x18
+	ReasonReAuthenticate                      byte = 0x19
+	ReasonUnspecifiedError                    byte = 0x80
+	ReasonMalformedPacket                     byte = 0x81
+	ReasonProtocolError                       byte = 0x82
+	ReasonImplementationSpecificError         byte = 0x83
+	ReasonUnsupportedProtocolVersion          byte = 0x84
+	ReasonClientIdentifierNotValid            byte = 0x85
+	ReasonBadUserNameOrPassword               byte = 0x86
+	ReasonNotAuthorized                       byte = 0x87
+	ReasonServerUnavailable                   byte = 0x88
+	ReasonServerBusy                          byte = 0x89
+	ReasonBanned                              byte = 0x8a
+	ReasonServerShuttingDown                  byte = 0x8b
+	ReasonBadAuthenticationMethod             byte = 0x8c
+	ReasonKeepAliveTimeout                    byte = 0x8d
+	ReasonSessionTakenOver                    byte = 0x8e
+	ReasonTopicFilterInvalid                  byte = 0x8f
+	ReasonTopicNameInvalid                    byte = 0x90
+	ReasonPacketIdentifierInUse               byte = 0x91
+	ReasonPacketIdentifierNotFound            byte = 0x92
+	ReasonReceiveMaximumExceeded              byte = 0x93
+	ReasonTopicAliasInvalid                   byte = 0x94
+	ReasonPacketTooLarge                      byte = 0x95
+	ReasonMessageRateTooHigh                  byte = 0x96
+	ReasonQuotaExceeded                       byte = 0x97
+	ReasonAdministrativeAction                byte = 0x98
+	ReasonPayloadFormatInvalid                byte = 0x99
+	ReasonRetainNotSupported                  byte = 0x9a
+	ReasonQoSNotSupported                     byte = 0x9b
+	ReasonUseAnotherServer                    byte = 0x9c
+	ReasonServerMoved                         byte = 0x9d
+	ReasonSharedSubscriptionsNotSupported     byte = 0x9e
+	ReasonConnectionRateExceeded              byte = 0x9f
+	ReasonMaximumConnectTime                  byte = 0xa0
+	ReasonSubscriptionIdentifiersNotSupported byte = 0xa1
+	ReasonWildcardSubscriptionsNotSupported   byte = 0xa2
+)
+
+// connAckReasonCodes maps MQTT 3.1.1 CONNACK return codes to MQTT 5 reason
+// codes.
+var connAckReasonCodes = map[byte]byte{
+	ConnAccepted:                           ReasonSuccess,
+	ConnRefusedUnacceptableProtocolVersion: ReasonUnsupportedProtocolVersion,
+	ConnRefusedIdentifierRejected:          ReasonClientIdentifierNotValid,
+	ConnRefusedServerUnavailable:           ReasonServerUnavailable,
+	ConnRefusedBadUsernameOrPassword:       ReasonBadUserNameOrPassword,
+	ConnRefusedNotAuthorized:               ReasonNotAuthorized,
+}
+
+// connAckReasonCode returns the MQTT 5 reason code for an MQTT 3.1.1
+// CONNACK return code.
+func connAckReasonCode(returnCode byte) byte {
+	if reason, ok := connAckReasonCodes[returnCode]; ok {
+		return reason
+	}
+	return ReasonUnspecifiedError
+}
+
+// connAckReturnCode returns the MQTT 3.1.1 CONNACK return code for an MQTT 5
+// reason code.
+func connAckReturnCode(reason byte) byte {
+	for returnCode, r := range connAckReasonCodes {
+		if r == reason {
+			return returnCode
+		}
+	}
+	switch reason {
+	case ReasonBanned, ReasonBadAuthenticationMethod:
+		return ConnRefusedNotAuthorized
+	}
+	return ConnRefusedServerUnavailable
+}
+
+// reasonCodeForError returns the reason code for disconnecting a client that
+// sent a packet which couldn't be decoded.
+func reasonCodeForError(err messages.Error) byte {
+	if err == messages.ErrProtocolError {
+		return ReasonProtocolError
+	}
+	return ReasonMalformedPacket
+}
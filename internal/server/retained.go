@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type RetainedMessage struct {
+	Topic   TopicName
+	Payload []byte
+	QoS     uint8
+	// Unix time when the message expires, 0 if it does not expire.
+	ExpiresAt int64
+	// Encoded MQTT 5 properties forwarded to subscribers.
+	Properties []byte
+}
+
+// RetainedStore persists retained messages across server restarts.
+type RetainedStore interface {
+	// Load returns all stored retained messages.
+	Load() ([]*RetainedMessage, error)
+	// Store sets msg as the retained message of msg.Topic.
+	Store(msg *RetainedMessage) error
+	// Delete removes the retained message of topic.
+	Delete(topic TopicName) error
+	Close() error
+}
+
+const (
+	retainedOpStore  = "store"
+	retainedOpDelete = "delete"
+)
+
+type retainedRecord struct {
+	Op      string    `json:"op"`
+	Topic   TopicName `json:"topic"`
+	QoS     uint8     `json:"qos,omitempty"`
+	Payload []byte    `json:"payload,omitempty"`
+
+	ExpiresAt  int64  `json:"expires_at,omitempty"`
+	Properties []byte `json:"properties,omitempty"`
+}
+
+// FileRetainedStore is a RetainedStore that appends every change to a log
+// file. The log is compacted periodically.
+type FileRetainedStore struct {
+	lock     sync.Mutex
+	journal  *journal
+	messages map[TopicName]*RetainedMessage
+
+	stop chan bool
+}
+
+// NewFileRetainedStore opens the retained message log at path. Every
+// compactionInterval, the log is compacted if it contains considerably more
+// records than retained messages.
+func NewFileRetainedStore(path string, compactionInterval time.Duration) (*FileRetainedStore, error) {
+	s := &FileRetainedStore{
+		messages: make(map[TopicName]*RetainedMessage),
+		stop:     make(chan bool),
+	}
+	j, err := openJournal(path, func(data []byte) error {
+		var r retainedRecord
+		if err := decodeRecord(data, &r); err != nil {
+			return err
+		}
+		switch r.Op {
+		case retainedOpStore:
+			s.messages[r.Topic] = &RetainedMessage{Topic: r.Topic, Payload: r.Payload, QoS: r.QoS, ExpiresAt: r.ExpiresAt, Properties: r.Properties}
+		case retainedOpDelete:
+			delete(s.messages, r.Topic)
+		default:
+			return fmt.Errorf("unknown op %q", r.Op)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.journal = j
+	if compactionInterval > 0 {
+		go s.compactPeriodically(compactionInterval)
+	}
+	return s, nil
+}
+
+func (s *FileRetainedStore) compactPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.compactIfNeeded(); err != nil {
+				logger.Warningf("Can't compact retained message store: %s", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *FileRetainedStore) compactIfNeeded() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.journal.size() <= 2*len(s.messages)+100 {
+		return nil
+	}
+	return s.compact()
+}
+
+// compact must be called with s.lock held.
+func (s *FileRetainedStore) compact() error {
+	logger.Infof("Compacting retained message store")
+	return s.journal.compact(func(write func(record interface{}) error) error {
+		for _, msg := range s.messages {
+			if err := write(&retainedRecord{Op: retainedOpStore, Topic: msg.Topic, QoS: msg.QoS, Payload: msg.Payload, ExpiresAt: msg.ExpiresAt, Properties: msg.Properties}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *FileRetainedStore) Load() ([]*RetainedMessage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var res []*RetainedMessage
+	for _, msg := range s.messages {
+		res = append(res, msg)
+	}
+	return res, nil
+}
+
+func (s *FileRetainedStore) Store(msg *RetainedMessage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.messages[msg.Topic] = msg
+	return s.journal.append(&retainedRecord{Op: retainedOpStore, Topic: msg.Topic, QoS: msg.QoS, Payload: msg.Payload, ExpiresAt: msg.ExpiresAt, Properties: msg.Properties})
+}
+
+func (s *FileRetainedStore) Delete(topic TopicName) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.messages[topic]; !ok {
+		return nil
+	}
+	delete(s.messages, topic)
+	return s.journal.append(&retainedRecord{Op: retainedOpDelete, Topic: topic})
+}
+
+func (s *FileRetainedStore) Close() error {
+	close(s.stop)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.compact(); err != nil {
+		logger.Warningf("Can't compact retained message store: %s", err)
+	}
+	return s.journal.close()
+}
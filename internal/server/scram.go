@@ -0,0 +1,274 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ScramSHA256 is the name of the SCRAM-SHA-256 authentication method
+// (RFC 7677).
+const ScramSHA256 = "SCRAM-SHA-256"
+
+// scramPrefix starts SCRAM-SHA-256 entries in password files. The format is
+// the one used by PostgreSQL:
+// "SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>", with salt
+// and keys in base64.
+const scramPrefix = ScramSHA256 + "$"
+
+// Parameters of the credentials made up for unknown users; they are the
+// ones PostgreSQL uses for new passwords.
+const (
+	scramUnknownUserSaltSize   = 16
+	scramUnknownUserIterations = 4096
+)
+
+// ScramCredentials is what the server knows about a user to authenticate it
+// with SCRAM (RFC 5802). The password itself can't be derived from it.
+type ScramCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// newScramCredentials derives the SCRAM-SHA-256 credentials for password.
+func newScramCredentials(password []byte, salt []byte, iterations int) *ScramCredentials {
+	saltedPassword := pbkdf2.Key(password, salt, iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return &ScramCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(saltedPassword, "Server Key"),
+	}
+}
+
+// parseScramCredentials parses a password file entry, see scramPrefix.
+func parseScramCredentials(hash string) (*ScramCredentials, error) {
+	parts := strings.Split(strings.TrimPrefix(hash, scramPrefix), "$")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed %s hash", ScramSHA256)
+	}
+	params := strings.Split(parts[0], ":")
+	keys := strings.Split(parts[1], ":")
+	if len(params) != 2 || len(keys) != 2 {
+		return nil, fmt.Errorf("malformed %s hash", ScramSHA256)
+	}
+	iterations, err := strconv.Atoi(params[0])
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("malformed %s iteration count %q", ScramSHA256, params[0])
+	}
+	creds := &ScramCredentials{Iterations: iterations}
+	for _, f := range []struct {
+		name string
+		s    string
+		b    *[]byte
+	}{
+		{"salt", params[1], &creds.Salt},
+		{"StoredKey", keys[0], &creds.StoredKey},
+		{"ServerKey", keys[1], &creds.ServerKey},
+	} {
+		if *f.b, err = base64.StdEncoding.DecodeString(f.s); err != nil {
+			return nil, fmt.Errorf("malformed %s %s: %s", ScramSHA256, f.name, err)
+		}
+	}
+	return creds, nil
+}
+
+// verify returns whether password matches the credentials.
+func (c *ScramCredentials) verify(password []byte) bool {
+	got := newScramCredentials(password, c.Salt, c.Iterations)
+	return subtle.ConstantTimeCompare(got.StoredKey, c.StoredKey) == 1
+}
+
+// ScramCredentialStore looks up the SCRAM credentials of users.
+type ScramCredentialStore interface {
+	// ScramCredentials returns the credentials of username, or nil if the
+	// user is unknown or has no SCRAM credentials.
+	ScramCredentials(username string) *ScramCredentials
+}
+
+type scramSHA256 struct {
+	credentials ScramCredentialStore
+
+	// Key the credentials of unknown users are derived from, created on
+	// first use.
+	lock          sync.Mutex
+	unknownSecret []byte
+}
+
+// NewScramSHA256 returns the SCRAM-SHA-256 authentication method for users
+// in credentials. Channel binding is not supported.
+func NewScramSHA256(credentials ScramCredentialStore) AuthMethod {
+	return &scramSHA256{credentials: credentials}
+}
+
+// unknownUserCredentials returns made-up credentials for a user without
+// SCRAM credentials. The exchange goes on with them and fails at the
+// client-final message, like for a wrong password, so that clients can't
+// find out which users exist. The same user always gets the same salt.
+func (m *scramSHA256) unknownUserCredentials(username string) (*ScramCredentials, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.unknownSecret == nil {
+		secret := make([]byte, sha256.Size)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		m.unknownSecret = secret
+	}
+	return &ScramCredentials{
+		Salt:       scramHMAC(m.unknownSecret, "salt:"+username)[:scramUnknownUserSaltSize],
+		Iterations: scramUnknownUserIterations,
+		StoredKey:  scramHMAC(m.unknownSecret, "StoredKey:"+username),
+		ServerKey:  scramHMAC(m.unknownSecret, "ServerKey:"+username),
+	}, nil
+}
+
+func (m *scramSHA256) Start(info *ClientInfo) AuthExchange {
+	return &scramExchange{method: m, info: info}
+}
+
+// scramExchange is the server side of a SCRAM exchange: client-first,
+// server-first, client-final, server-final.
+type scramExchange struct {
+	method *scramSHA256
+	info   *ClientInfo
+
+	// Set after the client-first message.
+	creds           *ScramCredentials
+	unknownUser     bool
+	username        string
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+}
+
+var errScramUnexpectedMessage = errors.New("unexpected SCRAM message")
+
+func (e *scramExchange) Next(data []byte) ([]byte, bool, error) {
+	if e.creds == nil {
+		res, err := e.clientFirst(string(data))
+		return res, false, err
+	}
+	if e.serverFirst == "" {
+		return nil, false, errScramUnexpectedMessage
+	}
+	res, err := e.clientFinal(string(data))
+	e.serverFirst = ""
+	return res, err == nil, err
+}
+
+// clientFirst handles "<gs2-header>n=<user>,r=<client nonce>" and returns
+// "r=<nonce>,s=<salt>,i=<iterations>".
+func (e *scramExchange) clientFirst(msg string) ([]byte, error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, errScramUnexpectedMessage
+	}
+	switch {
+	case parts[0] != "n" && parts[0] != "y":
+		return nil, errors.New("SCRAM channel binding is not supported")
+	case parts[1] != "":
+		return nil, errors.New("SCRAM authorization identities are not supported")
+	}
+	attrs := strings.Split(parts[2], ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") || len(attrs[1]) == 2 {
+		return nil, errScramUnexpectedMessage
+	}
+	username := strings.NewReplacer("=2C", ",", "=3D", "=").Replace(attrs[0][2:])
+	creds := e.method.credentials.ScramCredentials(username)
+	if creds == nil {
+		var err error
+		if creds, err = e.method.unknownUserCredentials(username); err != nil {
+			return nil, err
+		}
+		e.unknownUser = true
+	}
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, err
+	}
+	e.creds = creds
+	e.username = username
+	e.gs2Header = parts[0] + "," + parts[1] + ","
+	e.clientFirstBare = parts[2]
+	e.nonce = attrs[1][2:] + base64.StdEncoding.EncodeToString(serverNonce)
+	e.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", e.nonce, base64.StdEncoding.EncodeToString(creds.Salt), creds.Iterations)
+	return []byte(e.serverFirst), nil
+}
+
+// clientFinal handles "c=<gs2-header>,r=<nonce>,p=<proof>" and returns
+// "v=<server signature>".
+func (e *scramExchange) clientFinal(msg string) ([]byte, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, errScramUnexpectedMessage
+	}
+	withoutProof := msg[:i]
+	proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+	if err != nil {
+		return nil, errScramUnexpectedMessage
+	}
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || attrs[0] != "c="+base64.StdEncoding.EncodeToString([]byte(e.gs2Header)) || attrs[1] != "r="+e.nonce {
+		return nil, errScramUnexpectedMessage
+	}
+
+	authMessage := e.clientFirstBare + "," + e.serverFirst + "," + withoutProof
+	clientSignature := scramHMAC(e.creds.StoredKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return nil, errScramUnexpectedMessage
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if e.unknownUser {
+		return nil, fmt.Errorf("no SCRAM credentials for user %q", e.username)
+	}
+	if subtle.ConstantTimeCompare(storedKey[:], e.creds.StoredKey) != 1 {
+		return nil, fmt.Errorf("wrong SCRAM proof for user %q", e.username)
+	}
+	e.info.HasUsername = true
+	e.info.Username = e.username
+	serverSignature := scramHMAC(e.creds.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+func scramHMAC(key []byte, s string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
@@ -19,79 +19,331 @@
 package server
 
 import (
+	"crypto/tls"
+	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Server struct {
-	hostPort string
+	config Config
 
 	shouldStop chan bool
-	sessionsLock     sync.Mutex
-	sessions []*Session
 
+	listenersLock sync.Mutex
+	listeners     []*listener
+
+	sessionsLock sync.Mutex
+	sessions     []*Session
+
+	// Connected sessions, keyed by client id.
+	clients map[string]*Session
+	// Reason code and server reference for clients connecting after Drain,
+	// drainReasonCode is 0 if the server isn't draining.
+	drainReasonCode byte
+	drainReference  string
+	// State of sessions with cleanSession == 0, keyed by client id.
+	persistentSessions map[string]*sessionState
+	// Where persistent sessions are stored, nil if only in memory.
+	store Store
+
+	topicsLock sync.Mutex
+	topics     TopicList
+
+	// Number of messages sent to each shared subscription, used to take
+	// turns among the group members.
+	sharesLock    sync.Mutex
+	shareCounters map[TopicFilter]int
 }
 
-func New(hostPort string) *Server {
+func New(config Config) *Server {
 	return &Server{
-		hostPort: hostPort,
-		shouldStop: make(chan bool),
+		config:             config,
+		shouldStop:         make(chan bool),
+		clients:            make(map[string]*Session),
+		persistentSessions: make(map[string]*sessionState),
+		store:              config.SessionStore,
+		shareCounters:      make(map[TopicFilter]int),
 	}
 }
 
-func (s *Server) listenAndServe(listener net.Listener) {
+func (s *Server) listenAndServe(listener *listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			logger.Warningf("Can't accept connection: %s", err)
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logger.Warningf("Can't accept connection: %s", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			logger.Infof("Listener on %s closed: %s", listener.Addr(), err)
+			return
 		}
-		go func() {
-			sess := s.NewSession(conn)
-			logger.Infof("Starting session %+v", sess)
-			sess.Run()
-			s.Remove(sess)
-		}()
+		go s.serve(listener, conn)
 	}
 }
 
+func (s *Server) serve(listener *listener, conn net.Conn) {
+	host := hostOf(conn.RemoteAddr())
+	if !listener.acquire(host) {
+		logger.Warningf("Too many connections on %s, refusing %s", listener.config, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	defer listener.release(host)
+
+	var certIdentity string
+	if tlsConn, ok := conn.(*tls.Conn); ok && listener.config.TLS != nil {
+		identity, err := listener.config.TLS.handshake(tlsConn, 30*time.Second)
+		if err != nil {
+			logger.Infof("TLS handshake with %s failed, closing connection: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		certIdentity = identity
+	}
+	if wsConn, ok := conn.(*webSocketConn); ok && wsConn.tlsState != nil && listener.config.TLS != nil {
+		// The TLS handshake was done by the HTTP server.
+		identity, err := listener.config.TLS.identity(*wsConn.tlsState)
+		if err != nil {
+			logger.Infof("Client certificate of %s refused, closing connection: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		certIdentity = identity
+	}
+	sess := s.NewSession(conn)
+	sess.listener = listener
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		cred, err := peerCredentials(unixConn)
+		if err != nil {
+			logger.Warningf("Can't get peer credentials: %s", err)
+		}
+		sess.peerCredentials = cred
+	}
+	sess.certIdentity = certIdentity
+	logger.Infof("Starting session %d for %s", sess.id, conn.RemoteAddr())
+	sess.Run()
+	s.Remove(sess)
+	s.detachSessionState(sess)
+	if sess.sessionState != nil && sess.cleanSession {
+		s.redistributeShared(sess.sessionState)
+	}
+	close(sess.done)
+}
+
 func (s *Server) Start() error {
 	ticker := time.NewTicker(15 * time.Second)
 	go func() {
 		for range ticker.C {
 			s.RemoveDead()
+			s.purgeExpired()
+			s.expireSessions()
 		}
 	}()
 
-	logger.Infof("Listening on %s", s.hostPort)
-	listener, err := net.Listen("tcp", s.hostPort)
+	if err := s.loadRetainedMessages(); err != nil {
+		return err
+	}
+	if err := s.loadSessions(); err != nil {
+		return err
+	}
+
+	if err := s.listen(); err != nil {
+		s.closeListeners()
+		return err
+	}
+	<-s.shouldStop
+	s.closeListeners()
+	if s.config.RetainedStore != nil {
+		s.config.RetainedStore.Close()
+	}
+	if s.store != nil {
+		s.store.Close()
+	}
+	return nil
+}
+
+// loadSessions restores the persistent sessions from the session store. All
+// of them are offline until their clients reconnect.
+func (s *Server) loadSessions() error {
+	if s.store == nil {
+		return nil
+	}
+	sessions, err := s.store.Load()
+	if err != nil {
+		return err
+	}
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	for _, stored := range sessions {
+		state := newSessionState()
+		state.clientId = stored.ClientId
+		state.store = s.store
+		state.expiryInterval = stored.ExpiryInterval
+		if state.expiryInterval == 0 {
+			state.expiryInterval = sessionNeverExpires
+		}
+		// The server was down for an unknown time; the client gets the full
+		// interval to reconnect.
+		state.startExpiry(time.Now())
+		for filter, options := range stored.Subscriptions {
+			state.subscriptions[filter] = newSubscription(filter, options)
+		}
+		for packetId, msg := range stored.Publishes {
+			om := newOutstandingPublishMessageFromStore(msg)
+			om.packetId = packetId
+			state.unacknowledgedPublishes[packetId] = om
+		}
+		for packetId := range stored.PubRels {
+			state.unacknowledgedPubRels[packetId] = &outstandingPubRelMessage{outstandingMessage{packetId: packetId}}
+		}
+		for packetId := range stored.PubRecs {
+			state.unacknowledgedPubRecs[packetId] = &outstandingPubRecMessage{outstandingMessage{packetId: packetId}}
+		}
+		for _, msg := range stored.Queue {
+			state.queuedMessages = append(state.queuedMessages, newOutstandingPublishMessageFromStore(msg))
+		}
+		s.persistentSessions[stored.ClientId] = state
+	}
+	logger.Infof("Loaded %d persistent sessions", len(sessions))
+	return nil
+}
+
+func (s *Server) loadRetainedMessages() error {
+	if s.config.RetainedStore == nil {
+		return nil
+	}
+	msgs, err := s.config.RetainedStore.Load()
 	if err != nil {
 		return err
 	}
-	go s.listenAndServe(listener)
-	<- s.shouldStop
-	listener.Close()
+	s.topicsLock.Lock()
+	defer s.topicsLock.Unlock()
+	for _, msg := range msgs {
+		s.topics = append(s.topics, &Topic{
+			name: msg.Topic,
+			retainedMessage: &outstandingPublishMessage{
+				topic:      msg.Topic,
+				payload:    msg.Payload,
+				qos:        msg.QoS,
+				retain:     true,
+				expiresAt:  fromUnixTime(msg.ExpiresAt),
+				properties: decodeStoredProperties(msg.Properties),
+			},
+		})
+	}
+	logger.Infof("Loaded %d retained messages", len(msgs))
+	return nil
+}
+
+// retain stores om as the retained message of its topic. If om's payload is
+// empty, the topic's retained message is removed instead.
+func (s *Server) retain(om *outstandingPublishMessage) {
+	s.topicsLock.Lock()
+	defer s.topicsLock.Unlock()
+	topic := s.topics.find(om.topic)
+	if len(om.payload) == 0 { // [MQTT-3.3.1-10], [MQTT-3.3.1-11]
+		if topic != nil {
+			topic.retainedMessage = nil
+		}
+		if s.config.RetainedStore != nil {
+			if err := s.config.RetainedStore.Delete(om.topic); err != nil {
+				logger.Warningf("Can't delete retained message for %s: %s", om.topic, err)
+			}
+		}
+		return
+	}
+	if topic == nil {
+		topic = &Topic{name: om.topic}
+		s.topics = append(s.topics, topic)
+	}
+	topic.retainedMessage = om
+	if s.config.RetainedStore != nil {
+		err := s.config.RetainedStore.Store(&RetainedMessage{Topic: om.topic, Payload: om.payload, QoS: om.qos, ExpiresAt: unixTime(om.expiresAt), Properties: om.properties.Encode()})
+		if err != nil {
+			logger.Warningf("Can't store retained message for %s: %s", om.topic, err)
+		}
+	}
+}
+
+// retainedMessages returns the retained messages of all topics matching filter.
+func (s *Server) retainedMessages(filter TopicFilter) []*outstandingPublishMessage {
+	s.topicsLock.Lock()
+	defer s.topicsLock.Unlock()
+	var res []*outstandingPublishMessage
+	now := time.Now()
+	for _, topic := range s.topics.filter(filter) {
+		if topic.retainedMessage != nil && topic.retainedMessage.expired(now) {
+			s.expireRetained(topic)
+		}
+		if topic.retainedMessage != nil {
+			res = append(res, topic.retainedMessage)
+		}
+	}
+	return res
+}
+
+func (s *Server) listen() error {
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+
+	for _, config := range s.config.Listeners {
+		logger.Infof("Listening on %s", config)
+		listener, err := newListener(config)
+		if err != nil {
+			return fmt.Errorf("%s: %s", config, err)
+		}
+		s.listeners = append(s.listeners, listener)
+	}
+	for _, listener := range s.listeners {
+		go s.listenAndServe(listener)
+	}
 	return nil
 }
 
-func (s* Server) Stop() {
+func (s *Server) closeListeners() {
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	s.listeners = nil
+}
+
+// ReloadCertificates re-reads the TLS certificate, key, and CA files. New
+// connections will use the new certificates, established connections are
+// not affected.
+func (s *Server) ReloadCertificates() error {
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+	for _, listener := range s.listeners {
+		if listener.tlsLoader == nil {
+			continue
+		}
+		if err := listener.tlsLoader.reload(); err != nil {
+			return fmt.Errorf("%s: %s", listener.config, err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) Stop() {
 	s.shouldStop <- true
 }
 
 func (s *Server) NewSession(conn net.Conn) *Session {
-	id := nextSessionId
-	nextSessionId++
+	id := atomic.AddUint32(&nextSessionId, 1) - 1
 	sess := &Session{
-		id:                      id,
-		conn:                    conn,
-		createdAt:               time.Now(),
-		connected:               false,
-		nextPacketId:            1,
-		subscriptions:           make(map[TopicFilter]*Subscription),
-		unacknowledgedPublishes: make(map[uint16]*outstandingPublishMessage),
-		unacknowledgedPubRels:   make(map[uint16]*outstandingPubRelMessage),
-		unacknowledgedPubRecs:   make(map[uint16]*outstandingPubRecMessage),
-		server:                s,
+		sessionState: newSessionState(),
+		id:           id,
+		conn:         conn,
+		done:         make(chan struct{}),
+		createdAt:    time.Now(),
+		connected:    false,
+		server:       s,
 	}
 	s.sessionsLock.Lock()
 	defer s.sessionsLock.Unlock()
@@ -104,7 +356,7 @@ func (s *Server) RemoveDead() {
 	for _, sess := range s.sessions {
 		if sess.deadlineExceeded() {
 			logger.Infof("Session %d: No message within %s, closing.", sess.id, sess.keepAliveDuration)
-			sess.Close()
+			sess.disconnect(ReasonKeepAliveTimeout, "Keep alive timeout")
 			toRemove[sess] = true
 		}
 	}
@@ -123,6 +375,9 @@ func (s *Server) RemoveDead() {
 func (s *Server) Remove(c *Session) {
 	s.sessionsLock.Lock()
 	defer s.sessionsLock.Unlock()
+	if c.sessionState != nil && s.clients[c.clientId] == c {
+		delete(s.clients, c.clientId)
+	}
 	for i := 0; i < len(s.sessions); i++ {
 		if s.sessions[i] == c {
 			// See https://github.com/golang/go/wiki/SliceTricks
@@ -134,3 +389,161 @@ func (s *Server) Remove(c *Session) {
 	}
 }
 
+// takeOver registers sess as the session of clientId. If another session is
+// connected with the same client id, it is closed, and takeOver waits until
+// it has terminated and released its session state [MQTT-3.1.4-2].
+func (s *Server) takeOver(sess *Session, clientId string) {
+	s.sessionsLock.Lock()
+	old := s.clients[clientId]
+	s.clients[clientId] = sess
+	s.sessionsLock.Unlock()
+	if old == nil || old == sess {
+		return
+	}
+	logger.Infof("Session %d: Client %s is already connected in session %d, closing it", sess.id, clientId, old.id)
+	old.disconnect(ReasonSessionTakenOver, "Another connection with the same client id")
+	<-old.done
+}
+
+// attachSessionState sets up the session state for a newly connected client.
+// If cleanStart is false and there is a stored state for clientId, it is
+// attached to sess. If persistent is true, the state is kept after the
+// client disconnects. Returns whether a stored session state was resumed.
+//
+// For MQTT 3.1.1 clients, persistent is the opposite of cleanStart; MQTT 5
+// clients can resume a session without keeping it afterwards, and vice
+// versa.
+func (s *Server) attachSessionState(sess *Session, clientId string, cleanStart bool, persistent bool) bool {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	state, found := s.persistentSessions[clientId]
+	if cleanStart || (found && !persistent) {
+		// [MQTT-3.1.2-6]
+		delete(s.persistentSessions, clientId)
+		if s.store != nil {
+			if err := s.store.DeleteSession(clientId); err != nil {
+				logger.Warningf("Client %s: Can't delete session from store: %s", clientId, err)
+			}
+		}
+	}
+	if found && !cleanStart {
+		// [MQTT-3.1.2-4]
+		sess.sessionState = state
+		state.lock.Lock()
+		state.expiresAt = time.Time{}
+		state.lock.Unlock()
+		if !persistent {
+			state.store = nil
+		}
+		return true
+	}
+	sess.clientId = clientId
+	if !persistent {
+		return false
+	}
+	sess.store = s.store
+	s.persistentSessions[clientId] = sess.sessionState
+	sess.persist(func(store Store) error { return store.AddSession(clientId) })
+	return false
+}
+
+// detachSessionState marks the state of a terminated session as offline.
+// Messages for persistent sessions will be queued from now on, until the
+// session expires.
+func (s *Server) detachSessionState(sess *Session) {
+	if sess.sessionState == nil {
+		return
+	}
+	now := time.Now()
+	sess.lock.Lock()
+	detached := sess.sessionState.session == sess
+	if detached {
+		sess.sessionState.session = nil
+		sess.startExpiry(now)
+	}
+	sess.lock.Unlock()
+	if detached {
+		// The client may have set the expiry interval to 0 when
+		// disconnecting.
+		s.expireSession(sess.sessionState, now)
+	}
+}
+
+// sessionStates returns a snapshot of the states of all connected sessions
+// and all persistent sessions.
+func (s *Server) sessionStates() []*sessionState {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	seen := make(map[*sessionState]bool)
+	var res []*sessionState
+	for _, sess := range s.sessions {
+		if sess.connected && !seen[sess.sessionState] {
+			seen[sess.sessionState] = true
+			res = append(res, sess.sessionState)
+		}
+	}
+	for _, state := range s.persistentSessions {
+		if !seen[state] {
+			seen[state] = true
+			res = append(res, state)
+		}
+	}
+	return res
+}
+
+// enqueueIfOffline adds msg to the queue of an offline session, applying the
+// configured overflow policy. QoS 0 messages are not queued. If the client is
+// online, the message is not queued and the client's session is returned.
+func (s *Server) enqueueIfOffline(state *sessionState, msg *outstandingPublishMessage) *Session {
+	state.lock.Lock()
+	if state.session != nil {
+		defer state.lock.Unlock()
+		return state.session
+	}
+	if msg.qos == 0 {
+		state.lock.Unlock()
+		return nil
+	}
+	if s.queueFull(state) {
+		switch s.config.QueueOverflowPolicy {
+		case DropOldest:
+			state.dropOldestQueued()
+		case DropNewest:
+			logger.Infof("Queue of client %s is full, dropping message", state.clientId)
+			state.lock.Unlock()
+			return nil
+		case Disconnect:
+			logger.Infof("Queue of client %s is full, discarding session", state.clientId)
+			state.lock.Unlock()
+			s.sessionsLock.Lock()
+			if s.persistentSessions[state.clientId] == state {
+				delete(s.persistentSessions, state.clientId)
+				state.persist(func(store Store) error { return store.DeleteSession(state.clientId) })
+			}
+			s.sessionsLock.Unlock()
+			state.publishDelayedWill()
+			return nil
+		}
+	}
+	state.queuedMessages = append(state.queuedMessages, msg)
+	state.persist(func(store Store) error { return store.Enqueue(state.clientId, msg.toStoredMessage()) })
+	state.lock.Unlock()
+	return nil
+}
+
+// queueFull drops expired messages from the queue of state and returns
+// whether it still holds MaxQueuedMessages. Must be called with state.lock
+// held.
+func (s *Server) queueFull(state *sessionState) bool {
+	state.dropExpiredQueued(time.Now())
+	max := s.config.MaxQueuedMessages
+	return max > 0 && len(state.queuedMessages) >= max
+}
+
+// dropOldestQueued makes room in the full queue of s. Must be called with
+// s.lock held.
+func (s *sessionState) dropOldestQueued() {
+	logger.Infof("Queue of client %s is full, dropping oldest message", s.clientId)
+	s.queuedMessages = s.queuedMessages[1:]
+	s.persist(func(store Store) error { return store.Dequeue(s.clientId, 1) })
+}
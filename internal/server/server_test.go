@@ -19,11 +19,40 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
 	"github.com/asig/go-logging/logging"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/asig/mqttlite/internal/messages"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 type fakeConn struct {
@@ -66,6 +95,212 @@ func init() {
 	logger = logging.Get("test")
 }
 
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	msgs chan *messages.Message // closed when the connection is closed
+}
+
+func connectMessage(clientId string, cleanSession bool) *messages.Message {
+	var flags uint8
+	if cleanSession {
+		flags |= 2
+	}
+	msg := &messages.Message{Type: messages.Connect, Flags: 0, Data: []byte{}}
+	pw := msg.PayloadWriter()
+	pw.WriteString("MQTT")
+	pw.WriteUint8(4)
+	pw.WriteUint8(flags)
+	pw.WriteUint16(60)
+	pw.WriteString(clientId)
+	return msg
+}
+
+func connectMessageWithWill(clientId string, cleanSession bool, willTopic TopicName, willMessage string) *messages.Message {
+	msg := connectMessage(clientId, cleanSession)
+	msg.Data[7] |= 4
+	pw := msg.PayloadWriter()
+	pw.WriteString(string(willTopic))
+	pw.WriteString(willMessage)
+	return msg
+}
+
+func connectMessageWithCredentials(clientId string, username string, password string) *messages.Message {
+	msg := connectMessage(clientId, true)
+	msg.Data[7] |= 128 | 64
+	pw := msg.PayloadWriter()
+	pw.WriteString(username)
+	pw.WriteString(password)
+	return msg
+}
+
+// newTestClient connects a client to srv over an in-memory pipe and returns
+// the client together with the CONNACK it received.
+func newTestClient(t *testing.T, srv *Server, connect *messages.Message) (*testClient, *messages.Message) {
+	clientConn, serverConn := net.Pipe()
+	go srv.serve(&listener{config: &ListenerConfig{}}, serverConn)
+	c := startTestClient(t, clientConn)
+	c.send(connect)
+	return c, c.receive()
+}
+
+// startTestClient starts reading messages from clientConn in the background.
+func startTestClient(t *testing.T, clientConn net.Conn) *testClient {
+	c := &testClient{t, clientConn, make(chan *messages.Message, 100)}
+	go func() {
+		defer close(c.msgs)
+		for {
+			msg, err := messages.ReadMessageWithTimeout(clientConn, time.Minute, 0)
+			if err != messages.ErrNone {
+				return
+			}
+			c.msgs <- msg
+		}
+	}()
+	return c
+}
+
+func (c *testClient) send(msg *messages.Message) {
+	msg.Send(c.conn)
+}
+
+func (c *testClient) receive() *messages.Message {
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			c.t.Fatalf("Connection closed unexpectedly")
+		}
+		return msg
+	case <-time.After(2 * time.Second):
+		c.t.Fatalf("Timeout while waiting for message")
+	}
+	return nil
+}
+
+func (c *testClient) subscribe(packetId uint16, filter TopicFilter, qos uint8) *messages.Message {
+	msg := &messages.Message{Type: messages.Subscribe, Flags: 2, Data: []byte{}}
+	pw := msg.PayloadWriter()
+	pw.WriteUint16(packetId)
+	pw.WriteString(string(filter))
+	pw.WriteUint8(qos)
+	c.send(msg)
+	return c.receive()
+}
+
+func (c *testClient) publish(topic TopicName, payload string, qos uint8) {
+	c.publishWithRetain(topic, payload, qos, false)
+}
+
+func (c *testClient) publishWithRetain(topic TopicName, payload string, qos uint8, retain bool) {
+	msg := &messages.Message{Type: messages.Publish, Flags: qos << 1, Data: []byte{}}
+	if retain {
+		msg.Flags |= 1
+	}
+	pw := msg.PayloadWriter()
+	pw.WriteString(string(topic))
+	if qos > 0 {
+		pw.WriteUint16(1)
+	}
+	pw.WriteBytes([]byte(payload))
+	c.send(msg)
+	if qos > 0 {
+		c.receive() // PUBACK or PUBREC
+	}
+}
+
+// ping sends a PINGREQ and fails if the next message received is not a
+// PINGRESP.
+func (c *testClient) ping() {
+	c.send(&messages.Message{Type: messages.PingReq, Flags: 0, Data: []byte{}})
+	if msg := c.receive(); msg.Type != messages.PingResp {
+		c.t.Errorf("Expected PINGRESP, got %+v", msg)
+	}
+}
+
+// receivePayload reads a PUBLISH message and returns its payload.
+func (c *testClient) receivePayload() string {
+	return c.receivePublish().payload
+}
+
+type receivedPublish struct {
+	dup     bool
+	qos     uint8
+	payload string
+}
+
+func (c *testClient) receivePublish() receivedPublish {
+	return parsePublish(c.t, c.receive())
+}
+
+func parsePublish(t *testing.T, msg *messages.Message) receivedPublish {
+	if msg.Type != messages.Publish {
+		t.Fatalf("Expected PUBLISH, got %+v", msg)
+	}
+	pr := msg.PayloadReader(0)
+	pr.GetString()
+	if (msg.Flags>>1)&3 > 0 {
+		pr.GetUint16()
+	}
+	return receivedPublish{
+		dup:     msg.Flags&8 > 0,
+		qos:     (msg.Flags >> 1) & 3,
+		payload: string(msg.Data[pr.GetCurPos():]),
+	}
+}
+
+// expectClosed fails if the connection was not closed by the server.
+func (c *testClient) expectClosed() {
+	select {
+	case msg, ok := <-c.msgs:
+		if ok {
+			c.t.Errorf("Expected connection to be closed, got %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		c.t.Errorf("Timeout while waiting for connection to be closed")
+	}
+}
+
+func waitOffline(t *testing.T, srv *Server, clientId string) {
+	for i := 0; i < 100; i++ {
+		srv.sessionsLock.Lock()
+		state := srv.persistentSessions[clientId]
+		srv.sessionsLock.Unlock()
+		if state == nil { // discarded
+			return
+		}
+		state.lock.Lock()
+		online := state.session != nil
+		state.lock.Unlock()
+		if !online {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Client %s did not go offline", clientId)
+}
+
+// subscribeAll sends a single SUBSCRIBE message for all subs and returns the
+// SUBACK's return codes.
+func (c *testClient) subscribeAll(packetId uint16, subs ...Subscription) []byte {
+	msg := &messages.Message{Type: messages.Subscribe, Flags: 2, Data: []byte{}}
+	pw := msg.PayloadWriter()
+	pw.WriteUint16(packetId)
+	for _, sub := range subs {
+		pw.WriteString(string(sub.filter))
+		pw.WriteUint8(sub.qos)
+	}
+	c.send(msg)
+	subAck := c.receive()
+	if subAck.Type != messages.SubAck {
+		c.t.Fatalf("Expected SUBACK, got %+v", subAck)
+	}
+	return subAck.Data[2:]
+}
+
+func (c *testClient) close() {
+	c.conn.Close()
+}
+
 func TestSplit(t *testing.T) {
 	tests := []struct {
 		desc string
@@ -182,6 +417,18 @@ func TestTopicFilterMatches(t *testing.T) {
 			name:   TopicName("$SYS/monitor/Clients"),
 			want:   true,
 		},
+		{
+			desc:   "Filter longer than name",
+			filter: TopicFilter("sport/tennis/player1"),
+			name:   TopicName("sport/tennis"),
+			want:   false,
+		},
+		{
+			desc:   "Name longer than filter",
+			filter: TopicFilter("sport/tennis"),
+			name:   TopicName("sport/tennis/player1"),
+			want:   false,
+		},
 	}
 
 	for _, test := range tests {
@@ -195,7 +442,7 @@ func TestTopicFilterMatches(t *testing.T) {
 }
 
 func TestSessionlistRemoveDead(t *testing.T) {
-	srv := New("")
+	srv := New(Config{})
 	srv.sessions = []*Session{
 		&Session{
 			id:                  23,
@@ -220,3 +467,2413 @@ func TestSessionlistRemoveDead(t *testing.T) {
 		}
 	}
 }
+
+func TestPersistentSession(t *testing.T) {
+	tests := []struct {
+		desc               string
+		cleanSession       bool
+		wantSessionPresent byte
+		wantSubscriptions  int
+	}{
+		{
+			desc:               "Resume session",
+			cleanSession:       false,
+			wantSessionPresent: 1,
+			wantSubscriptions:  1,
+		},
+		{
+			desc:               "Discard session",
+			cleanSession:       true,
+			wantSessionPresent: 0,
+			wantSubscriptions:  0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := New(Config{})
+			c, connAck := newTestClient(t, srv, connectMessage("client", false))
+			if connAck.Data[0] != 0 {
+				t.Errorf("First CONNACK: got session present %d, want 0", connAck.Data[0])
+			}
+			c.subscribe(1, "a/b", 1)
+			c.close()
+
+			c, connAck = newTestClient(t, srv, connectMessage("client", test.cleanSession))
+			defer c.close()
+			if connAck.Data[0] != test.wantSessionPresent {
+				t.Errorf("Second CONNACK: got session present %d, want %d", connAck.Data[0], test.wantSessionPresent)
+			}
+			srv.sessionsLock.Lock()
+			state, ok := srv.persistentSessions["client"]
+			srv.sessionsLock.Unlock()
+			if ok == test.cleanSession {
+				t.Errorf("persistentSessions[\"client\"] present: got %t, want %t", ok, !test.cleanSession)
+			}
+			if ok && len(state.subscriptions) != test.wantSubscriptions {
+				t.Errorf("len(subscriptions): got %d, want %d", len(state.subscriptions), test.wantSubscriptions)
+			}
+		})
+	}
+}
+
+func TestEmptyClientId(t *testing.T) {
+	srv := New(Config{})
+	c, connAck := newTestClient(t, srv, connectMessage("", false))
+	defer c.close()
+	if connAck.Data[1] != 0x02 {
+		t.Errorf("CONNACK return code: got %d, want %d", connAck.Data[1], 0x02)
+	}
+}
+
+func TestOfflineQueue(t *testing.T) {
+	tests := []struct {
+		desc               string
+		policy             OverflowPolicy
+		wantSessionPresent byte
+		want               []string
+	}{
+		{
+			desc:               "Drop oldest",
+			policy:             DropOldest,
+			wantSessionPresent: 1,
+			want:               []string{"2", "3"},
+		},
+		{
+			desc:               "Drop newest",
+			policy:             DropNewest,
+			wantSessionPresent: 1,
+			want:               []string{"1", "2"},
+		},
+		{
+			desc:               "Disconnect",
+			policy:             Disconnect,
+			wantSessionPresent: 0,
+			want:               nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := New(Config{MaxQueuedMessages: 2, QueueOverflowPolicy: test.policy})
+			sub, _ := newTestClient(t, srv, connectMessage("sub", false))
+			sub.subscribe(1, "t", 1)
+			sub.close()
+			waitOffline(t, srv, "sub")
+
+			pub, _ := newTestClient(t, srv, connectMessage("pub", true))
+			defer pub.close()
+			pub.publish("t", "1", 1)
+			pub.publish("t", "2", 1)
+			pub.publish("t", "0", 0) // QoS 0 messages are not queued
+			pub.publish("t", "3", 1)
+
+			sub, connAck := newTestClient(t, srv, connectMessage("sub", false))
+			defer sub.close()
+			if connAck.Data[0] != test.wantSessionPresent {
+				t.Errorf("CONNACK: got session present %d, want %d", connAck.Data[0], test.wantSessionPresent)
+			}
+			var got []string
+			for range test.want {
+				got = append(got, sub.receivePayload())
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Received payloads: got %q, want %q", got, test.want)
+			}
+			sub.ping()
+		})
+	}
+}
+
+// TestPendingQueue checks that messages waiting for the receive maximum of a
+// connected client are limited like the queue of an offline one.
+func TestPendingQueue(t *testing.T) {
+	tests := []struct {
+		desc               string
+		policy             OverflowPolicy
+		wantSessionPresent byte
+		want               []string // after the message in flight
+	}{
+		{"Drop oldest", DropOldest, 1, []string{"3", "4"}},
+		{"Drop newest", DropNewest, 1, []string{"2", "3"}},
+		{"Disconnect", Disconnect, 0, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := New(Config{ReceiveMaximum: 1, MaxQueuedMessages: 2, QueueOverflowPolicy: test.policy})
+			sub, _ := newTestClient(t, srv, connectMessage("sub", false))
+			sub.subscribe(1, "t", 1)
+
+			pub, _ := newTestClient(t, srv, connectMessage("pub", true))
+			defer pub.close()
+			pub.publish("t", "1", 1) // in flight
+			pub.publish("t", "2", 1)
+			pub.publish("t", "3", 1)
+			pub.publish("t", "0", 0) // QoS 0 messages are not queued
+			pub.publish("t", "4", 1)
+
+			// receive reads the next PUBLISH and returns its packet id.
+			receive := func(want string, qos uint8) uint16 {
+				msg := sub.receive()
+				if got := parsePublish(t, msg); got.payload != want {
+					t.Errorf("Got payload %q, want %q", got.payload, want)
+				}
+				if qos == 0 {
+					return 0
+				}
+				pr := msg.PayloadReader(0)
+				pr.GetString()
+				return pr.GetUint16()
+			}
+			packetId := receive("1", 1)
+			receive("0", 0)
+			for _, want := range test.want {
+				puback := &messages.Message{Type: messages.PubAck, Flags: 0, Data: []byte{}}
+				puback.PayloadWriter().WriteUint16(packetId)
+				sub.send(puback)
+				packetId = receive(want, 1)
+			}
+			if test.policy == Disconnect {
+				sub.expectClosed()
+			}
+			sub.close()
+			waitOffline(t, srv, "sub")
+
+			sub, connAck := newTestClient(t, srv, connectMessage("sub", false))
+			defer sub.close()
+			if connAck.Data[0] != test.wantSessionPresent {
+				t.Errorf("CONNACK: got session present %d, want %d", connAck.Data[0], test.wantSessionPresent)
+			}
+		})
+	}
+}
+
+func TestSessionTakeover(t *testing.T) {
+	srv := New(Config{})
+	observer, _ := newTestClient(t, srv, connectMessage("observer", true))
+	defer observer.close()
+	observer.subscribe(1, "will", 0)
+
+	old, _ := newTestClient(t, srv, connectMessageWithWill("client", false, "will", "gone"))
+	defer old.close()
+	old.subscribe(1, "t", 1)
+
+	pub, _ := newTestClient(t, srv, connectMessage("pub", true))
+	defer pub.close()
+	pub.publish("t", "in flight", 1)
+	// Receive, but don't acknowledge
+	if got := old.receivePayload(); got != "in flight" {
+		t.Errorf("Old session: got payload %q, want %q", got, "in flight")
+	}
+
+	new, connAck := newTestClient(t, srv, connectMessage("client", false))
+	defer new.close()
+	old.expectClosed()
+	if got := observer.receivePayload(); got != "gone" {
+		t.Errorf("Will message: got payload %q, want %q", got, "gone")
+	}
+	if connAck.Data[0] != 1 {
+		t.Errorf("CONNACK: got session present %d, want 1", connAck.Data[0])
+	}
+	got := new.receivePublish()
+	want := receivedPublish{dup: true, qos: 1, payload: "in flight"}
+	if got != want {
+		t.Errorf("New session: got %+v, want %+v", got, want)
+	}
+
+	srv.sessionsLock.Lock()
+	defer srv.sessionsLock.Unlock()
+	if len(srv.clients) != 3 {
+		t.Errorf("len(clients): got %d, want 3", len(srv.clients))
+	}
+}
+
+func TestFileRetainedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqttlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "retained.log")
+
+	store, err := NewFileRetainedStore(path, 0)
+	if err != nil {
+		t.Fatalf("NewFileRetainedStore: %s", err)
+	}
+	store.Store(&RetainedMessage{Topic: "a", Payload: []byte("1"), QoS: 1})
+	store.Store(&RetainedMessage{Topic: "b", Payload: []byte("2"), QoS: 0})
+	store.Store(&RetainedMessage{Topic: "a", Payload: []byte("3"), QoS: 2})
+	store.Store(&RetainedMessage{Topic: "c", Payload: []byte("4"), QoS: 0})
+	store.Delete("b")
+	// Don't close the store to simulate a crash: the log must not be compacted.
+	store.journal.close()
+
+	want := []*RetainedMessage{
+		{Topic: "a", Payload: []byte("3"), QoS: 2},
+		{Topic: "c", Payload: []byte("4"), QoS: 0},
+	}
+	for _, desc := range []string{"Uncompacted", "Compacted"} {
+		t.Run(desc, func(t *testing.T) {
+			store, err := NewFileRetainedStore(path, 0)
+			if err != nil {
+				t.Fatalf("NewFileRetainedStore: %s", err)
+			}
+			got, _ := store.Load()
+			sort.Slice(got, func(i, j int) bool { return got[i].Topic < got[j].Topic })
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Load(): got %+v, want %+v", got, want)
+			}
+			store.Close()
+			if store.journal.records != len(want) {
+				t.Errorf("Records after compaction: got %d, want %d", store.journal.records, len(want))
+			}
+		})
+	}
+}
+
+func TestJournalPartialRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"Partial record", "{\"n\":1}\n{\"n\":2}\n{\"n\":"},
+		{"Missing newline", "{\"n\":1}\n{\"n\":2}"},
+		{"Complete", "{\"n\":1}\n{\"n\":2}\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeTempFile(t, test.content)
+			defer os.Remove(path)
+			var got []int
+			replay := func(data []byte) error {
+				var record struct{ N int }
+				if err := decodeRecord(data, &record); err != nil {
+					return err
+				}
+				got = append(got, record.N)
+				return nil
+			}
+			j, err := openJournal(path, replay)
+			if err != nil {
+				t.Fatalf("openJournal: %s", err)
+			}
+			j.append(struct{ N int }{3})
+			j.close()
+
+			got = nil
+			if j, err = openJournal(path, replay); err != nil {
+				t.Fatalf("openJournal: %s", err)
+			}
+			j.close()
+			if want := []int{1, 2, 3}; !reflect.DeepEqual(got, want) {
+				t.Errorf("Records after reopening: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRetainedMessages(t *testing.T) {
+	srv := New(Config{})
+	pub, _ := newTestClient(t, srv, connectMessage("pub", true))
+	defer pub.close()
+	pub.publishWithRetain("a/b", "retained", 1, true)
+	pub.publishWithRetain("a/c", "cleared", 1, true)
+	pub.publishWithRetain("a/c", "", 0, true)
+
+	sub, _ := newTestClient(t, srv, connectMessage("sub", true))
+	defer sub.close()
+	if got := sub.subscribe(1, "a/+", 0); got.Type != messages.SubAck {
+		t.Errorf("Expected SUBACK, got %+v", got)
+	}
+	want := receivedPublish{qos: 0, payload: "retained"}
+	if got := sub.receivePublish(); got != want {
+		t.Errorf("Retained message: got %+v, want %+v", got, want)
+	}
+	sub.ping()
+}
+
+func TestFileStoreBadRecords(t *testing.T) {
+	path := writeTempFile(t, `{"op":"add_session","client_id":"a"}
+{"op":"session","client_id":"b"}
+{"op":"store_publish","client_id":"a"}
+{"op":"enqueue","client_id":"a"}
+`)
+	defer os.Remove(path)
+	store, err := NewFileStore(path, 0)
+	if err != nil {
+		t.Fatalf("NewFileStore: %s", err)
+	}
+	defer store.Close()
+	got, _ := store.Load()
+	want := []*StoredSession{newStoredSession("a")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Load(): got %+v, want %+v", got, want)
+	}
+}
+
+func TestFileStoreRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqttlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions.log")
+
+	store, err := NewFileStore(path, 0)
+	if err != nil {
+		t.Fatalf("NewFileStore: %s", err)
+	}
+	srv := New(Config{SessionStore: store})
+	sub, _ := newTestClient(t, srv, connectMessage("sub", false))
+	sub.subscribe(1, "t", 2)
+	sub.subscribe(2, "u", 1)
+	sub.subscribe(3, "v", 1)
+	sub.send(&messages.Message{Type: messages.Unsubscribe, Flags: 2, Data: []byte{0, 4, 0, 1, 'v'}})
+	sub.receive() // UNSUBACK
+
+	pub, _ := newTestClient(t, srv, connectMessage("pub", true))
+	defer pub.close()
+	pub.publish("t", "in flight", 2)
+	sub.receivePayload() // Don't acknowledge
+	sub.close()
+	waitOffline(t, srv, "sub")
+	pub.publish("u", "queued", 1)
+	pub.publish("v", "unsubscribed", 1)
+	store.Close()
+
+	// Restart
+	store, err = NewFileStore(path, 0)
+	if err != nil {
+		t.Fatalf("NewFileStore: %s", err)
+	}
+	defer store.Close()
+	srv = New(Config{SessionStore: store})
+	if err := srv.loadSessions(); err != nil {
+		t.Fatalf("loadSessions: %s", err)
+	}
+	sub, connAck := newTestClient(t, srv, connectMessage("sub", false))
+	defer sub.close()
+	if connAck.Data[0] != 1 {
+		t.Errorf("CONNACK: got session present %d, want 1", connAck.Data[0])
+	}
+	want := []receivedPublish{
+		{dup: true, qos: 2, payload: "in flight"},
+		{dup: false, qos: 1, payload: "queued"},
+	}
+	for _, w := range want {
+		if got := sub.receivePublish(); got != w {
+			t.Errorf("Got %+v, want %+v", got, w)
+		}
+	}
+	sub.ping()
+}
+
+func TestQoS2Duplicates(t *testing.T) {
+	srv := New(Config{})
+	sub, _ := newTestClient(t, srv, connectMessage("sub", true))
+	defer sub.close()
+	sub.subscribe(1, "t", 0)
+
+	pub, _ := newTestClient(t, srv, connectMessage("pub", true))
+	defer pub.close()
+	pub.publish("t", "once", 2)
+	pub.publish("t", "once", 2) // Retransmission: same packet id, no PUBREL yet
+
+	if got := sub.receivePayload(); got != "once" {
+		t.Errorf("Got payload %q, want %q", got, "once")
+	}
+	sub.ping()
+}
+
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "mqttlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestPasswordFileAuthenticator(t *testing.T) {
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("secret1"), bcrypt.MinCost)
+	salt := []byte("0123456789abcdef")
+	argon2Hash := fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("secret2"), salt, 1, 1024, 1, 32)))
+	path := writeTempFile(t, fmt.Sprintf("# users\nalice:%s\n\nbob:%s\ndave:%s\n", bcryptHash, argon2Hash, scramHash("secret3")))
+	defer os.Remove(path)
+
+	auth, err := NewPasswordFileAuthenticator(path, false)
+	if err != nil {
+		t.Fatalf("NewPasswordFileAuthenticator: %s", err)
+	}
+
+	tests := []struct {
+		desc string
+		info ClientInfo
+		want byte
+	}{
+		{
+			desc: "bcrypt",
+			info: ClientInfo{HasUsername: true, Username: "alice", HasPassword: true, Password: []byte("secret1")},
+			want: ConnAccepted,
+		},
+		{
+			desc: "bcrypt, wrong password",
+			info: ClientInfo{HasUsername: true, Username: "alice", HasPassword: true, Password: []byte("secret2")},
+			want: ConnRefusedBadUsernameOrPassword,
+		},
+		{
+			desc: "argon2id",
+			info: ClientInfo{HasUsername: true, Username: "bob", HasPassword: true, Password: []byte("secret2")},
+			want: ConnAccepted,
+		},
+		{
+			desc: "argon2id, wrong password",
+			info: ClientInfo{HasUsername: true, Username: "bob", HasPassword: true, Password: []byte("secret1")},
+			want: ConnRefusedBadUsernameOrPassword,
+		},
+		{
+			desc: "SCRAM-SHA-256",
+			info: ClientInfo{HasUsername: true, Username: "dave", HasPassword: true, Password: []byte("secret3")},
+			want: ConnAccepted,
+		},
+		{
+			desc: "SCRAM-SHA-256, wrong password",
+			info: ClientInfo{HasUsername: true, Username: "dave", HasPassword: true, Password: []byte("secret1")},
+			want: ConnRefusedBadUsernameOrPassword,
+		},
+		{
+			desc: "No password",
+			info: ClientInfo{HasUsername: true, Username: "bob"},
+			want: ConnRefusedBadUsernameOrPassword,
+		},
+		{
+			desc: "Unknown user",
+			info: ClientInfo{HasUsername: true, Username: "carol", HasPassword: true, Password: []byte("secret1")},
+			want: ConnRefusedBadUsernameOrPassword,
+		},
+		{
+			desc: "Anonymous",
+			info: ClientInfo{},
+			want: ConnRefusedNotAuthorized,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := auth.Authenticate(&test.info); got != test.want {
+				t.Errorf("Authenticate(%+v): got %d, want %d", test.info, got, test.want)
+			}
+		})
+	}
+}
+
+// scramHash returns a SCRAM-SHA-256 password file entry for password.
+func scramHash(password string) string {
+	creds := newScramCredentials([]byte(password), []byte("0123456789abcdef"), 4096)
+	return fmt.Sprintf("SCRAM-SHA-256$%d:%s$%s:%s", creds.Iterations,
+		base64.StdEncoding.EncodeToString(creds.Salt),
+		base64.StdEncoding.EncodeToString(creds.StoredKey),
+		base64.StdEncoding.EncodeToString(creds.ServerKey))
+}
+
+func TestAuthenticationFailure(t *testing.T) {
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	path := writeTempFile(t, fmt.Sprintf("alice:%s\n", bcryptHash))
+	defer os.Remove(path)
+	auth, err := NewPasswordFileAuthenticator(path, false)
+	if err != nil {
+		t.Fatalf("NewPasswordFileAuthenticator: %s", err)
+	}
+	srv := New(Config{Authenticator: auth})
+
+	c, connAck := newTestClient(t, srv, connectMessageWithCredentials("client", "alice", "wrong"))
+	defer c.close()
+	if connAck.Data[1] != ConnRefusedBadUsernameOrPassword {
+		t.Errorf("CONNACK return code: got %d, want %d", connAck.Data[1], ConnRefusedBadUsernameOrPassword)
+	}
+	c.expectClosed()
+
+	c, connAck = newTestClient(t, srv, connectMessageWithCredentials("client", "alice", "secret"))
+	defer c.close()
+	if connAck.Data[1] != ConnAccepted {
+		t.Errorf("CONNACK return code: got %d, want %d", connAck.Data[1], ConnAccepted)
+	}
+}
+
+func TestTopicFilterCovers(t *testing.T) {
+	tests := []struct {
+		filter TopicFilter
+		other  TopicFilter
+		want   bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/+/c", true},
+		{"a/#", "a/#", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/+", true},
+		{"a/+", "a/#", false},
+		{"a/+", "a/b/c", false},
+		{"a/b", "a/+", false},
+		{"a/+/c", "a/+/+", false},
+		{"#", "#", true},
+		{"#", "$SYS/foo", false},
+		{"+/foo", "$SYS/foo", false},
+	}
+
+	for _, test := range tests {
+		got := test.filter.covers(test.other)
+		if got != test.want {
+			t.Errorf("%q.covers(%q): got %t, want %t", test.filter, test.other, got, test.want)
+		}
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	path := writeTempFile(t, `
+# global rules
+topic read public/#
+topic devices/%c/#
+topic write users/%u/status
+
+user alice
+topic readwrite alice/#
+
+client admin
+topic #
+`)
+	defer os.Remove(path)
+	acl, err := NewACLFile(path)
+	if err != nil {
+		t.Fatalf("NewACLFile: %s", err)
+	}
+
+	alice := &ClientInfo{ClientId: "phone", HasUsername: true, Username: "alice"}
+	anonymous := &ClientInfo{ClientId: "sensor"}
+	admin := &ClientInfo{ClientId: "admin"}
+	evil := &ClientInfo{ClientId: "+", HasUsername: true, Username: "#"}
+
+	tests := []struct {
+		desc      string
+		info      *ClientInfo
+		subscribe bool
+		topic     string
+		want      bool
+	}{
+		{"Global read", anonymous, true, "public/news", true},
+		{"Global read, publish", anonymous, false, "public/news", false},
+		{"Global read, subscribe wildcard", anonymous, true, "public/#", true},
+		{"Global read, subscribe too wide", anonymous, true, "#", false},
+		{"Client id substitution, publish", anonymous, false, "devices/sensor/temp", true},
+		{"Client id substitution, subscribe", anonymous, true, "devices/sensor/#", true},
+		{"Client id substitution, other client", anonymous, false, "devices/phone/temp", false},
+		{"User name substitution", alice, false, "users/alice/status", true},
+		{"User name substitution, no user name", anonymous, false, "users//status", false},
+		{"User rules", alice, true, "alice/+/inbox", true},
+		{"User rules, other user", anonymous, true, "alice/inbox", false},
+		{"Client rules", admin, true, "#", true},
+		{"Wildcards in substitutions", evil, true, "devices/+/#", false},
+		{"Wildcards in substitutions, publish", evil, false, "users/#/status", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			var got bool
+			if test.subscribe {
+				got = acl.CanSubscribe(test.info, TopicFilter(test.topic))
+			} else {
+				got = acl.CanPublish(test.info, TopicName(test.topic))
+			}
+			if got != test.want {
+				t.Errorf("Access to %q: got %t, want %t", test.topic, got, test.want)
+			}
+		})
+	}
+}
+
+func TestACLEnforcement(t *testing.T) {
+	path := writeTempFile(t, "topic read public/#\ntopic write public/%c\n")
+	defer os.Remove(path)
+	acl, err := NewACLFile(path)
+	if err != nil {
+		t.Fatalf("NewACLFile: %s", err)
+	}
+	srv := New(Config{Authorizer: acl})
+
+	sub, _ := newTestClient(t, srv, connectMessage("sub", true))
+	defer sub.close()
+	if subAck := sub.subscribe(1, "private/#", 1); subAck.Data[2] != subAckFailure {
+		t.Errorf("SUBACK for forbidden filter: got %d, want %d", subAck.Data[2], subAckFailure)
+	}
+	if subAck := sub.subscribe(2, "public/#", 1); subAck.Data[2] != 1 {
+		t.Errorf("SUBACK for allowed filter: got %d, want %d", subAck.Data[2], 1)
+	}
+
+	pub, _ := newTestClient(t, srv, connectMessage("pub", true))
+	defer pub.close()
+	pub.publish("public/sub", "forbidden", 1)
+	pub.publish("public/pub", "allowed", 1)
+	if got := sub.receivePayload(); got != "allowed" {
+		t.Errorf("Got payload %q, want %q", got, "allowed")
+	}
+}
+
+func TestTopicFilterValid(t *testing.T) {
+	tests := []struct {
+		filter TopicFilter
+		want   bool
+	}{
+		{"a/b", true},
+		{"/", true},
+		{"#", true},
+		{"a/#", true},
+		{"+/+", true},
+		{"a/+/c", true},
+		{"", false},
+		{"a/#/c", false},
+		{"a#", false},
+		{"a/b+", false},
+		{"a/\x00", false},
+		{"$share/g/a/+", true},
+		{"$share/g/#", true},
+		{"$share", true},
+		{"$share/g", false},
+		{"$share/g/", false},
+		{"$share//a", false},
+		{"$share/g+/a", false},
+		{"$share/g/a#", false},
+	}
+
+	for _, test := range tests {
+		if got := test.filter.valid(); got != test.want {
+			t.Errorf("%q.valid(): got %t, want %t", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestSubAckReturnCodes(t *testing.T) {
+	path := writeTempFile(t, "topic #\ntopic read $SYS/#\n")
+	defer os.Remove(path)
+	acl, err := NewACLFile(path)
+	if err != nil {
+		t.Fatalf("NewACLFile: %s", err)
+	}
+	srv := New(Config{Authorizer: acl})
+	c, _ := newTestClient(t, srv, connectMessage("client", true))
+	defer c.close()
+
+	got := c.subscribeAll(1,
+		Subscription{qos: 1, filter: "a/b"},
+		Subscription{qos: 0, filter: "a/#/b"},
+		Subscription{qos: 2, filter: "c/+"},
+		Subscription{qos: 1, filter: ""},
+		Subscription{qos: 2, filter: "$SYS/#"},
+		Subscription{qos: 1, filter: "$private"},
+	)
+	want := []byte{1, subAckFailure, 2, subAckFailure, 2, subAckFailure}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SUBACK return codes: got %v, want %v", got, want)
+	}
+
+	srv.sessionsLock.Lock()
+	sess := srv.clients["client"]
+	srv.sessionsLock.Unlock()
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	if len(sess.subscriptions) != 3 {
+		t.Errorf("len(subscriptions): got %d, want 3", len(sess.subscriptions))
+	}
+}
+
+// writeTestCertificate creates a self-signed certificate for commonName and
+// writes it and its key to PEM files in dir.
+func writeTestCertificate(t *testing.T, dir string, commonName string) (certFile string, keyFile string) {
+	return issueTestCertificate(t, dir, commonName, "", "")
+}
+
+// issueTestCertificate is like writeTestCertificate, but signs the
+// certificate with the CA in caCertFile and caKeyFile if they are given.
+func issueTestCertificate(t *testing.T, dir string, commonName string, caCertFile, caKeyFile string) (certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	parent, signer := template, crypto.Signer(key)
+	if caCertFile != "" {
+		ca, err := tls.LoadX509KeyPair(caCertFile, caKeyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+			t.Fatal(err)
+		}
+		signer = ca.PrivateKey.(crypto.Signer)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, commonName+".crt")
+	keyFile = filepath.Join(dir, commonName+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+// tlsHandshake performs a TLS handshake over an in-memory pipe and returns
+// the common name of the server's certificate.
+func tlsHandshake(t *testing.T, serverConfig *tls.Config) string {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	go tls.Server(serverConn, serverConfig).Handshake()
+	client := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("Handshake: %s", err)
+	}
+	return client.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestTLSCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqttlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificate(t, dir, "old")
+	config := &TLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: tls.VersionTLS12}
+	loader, err := newTLSConfigLoader(config)
+	if err != nil {
+		t.Fatalf("newTLSConfigLoader: %s", err)
+	}
+	serverConfig := loader.serverConfig()
+
+	if got := tlsHandshake(t, serverConfig); got != "old" {
+		t.Errorf("Before reload: got certificate for %q, want %q", got, "old")
+	}
+	config.CertFile, config.KeyFile = writeTestCertificate(t, dir, "new")
+	if err := loader.reload(); err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+	if got := tlsHandshake(t, serverConfig); got != "new" {
+		t.Errorf("After reload: got certificate for %q, want %q", got, "new")
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqttlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverCert, serverKey := writeTestCertificate(t, dir, "server")
+	caCert, caKey := writeTestCertificate(t, dir, "ca")
+	deviceCert, deviceKey := issueTestCertificate(t, dir, "device-1", caCert, caKey)
+	rogueCert, rogueKey := writeTestCertificate(t, dir, "device-2")
+
+	aclPath := writeTempFile(t, "topic readwrite devices/%u/#\n")
+	defer os.Remove(aclPath)
+	acl, err := NewACLFile(aclPath)
+	if err != nil {
+		t.Fatalf("NewACLFile: %s", err)
+	}
+	passwordPath := writeTempFile(t, "")
+	defer os.Remove(passwordPath)
+	authenticator, err := NewPasswordFileAuthenticator(passwordPath, false)
+	if err != nil {
+		t.Fatalf("NewPasswordFileAuthenticator: %s", err)
+	}
+	config := &TLSConfig{
+		CertFile:           serverCert,
+		KeyFile:            serverKey,
+		CAFile:             caCert,
+		RequireClientCert:  true,
+		IdentitySource:     CertIdentityCommonName,
+		IdentityAsUsername: true,
+		IdentityAsClientId: true,
+	}
+	loader, err := newTLSConfigLoader(config)
+	if err != nil {
+		t.Fatalf("newTLSConfigLoader: %s", err)
+	}
+	srv := New(Config{Authenticator: authenticator, Authorizer: acl})
+	tlsListener := &listener{config: &ListenerConfig{TLS: config}, tlsLoader: loader}
+
+	connect := func(certFile, keyFile string) *testClient {
+		clientConfig := &tls.Config{InsecureSkipVerify: true}
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientConfig.Certificates = []tls.Certificate{cert}
+		}
+		clientConn, serverConn := net.Pipe()
+		go srv.serve(tlsListener, tls.Server(serverConn, loader.serverConfig()))
+		c := startTestClient(t, tls.Client(clientConn, clientConfig))
+		c.send(connectMessage("ignored", true))
+		return c
+	}
+
+	c := connect(deviceCert, deviceKey)
+	defer c.close()
+	if connAck := c.receive(); connAck.Data[1] != ConnAccepted {
+		t.Fatalf("CONNACK: got %d, want %d", connAck.Data[1], ConnAccepted)
+	}
+	if subAck := c.subscribe(1, "devices/device-1/#", 1); subAck.Data[2] != 1 {
+		t.Errorf("SUBACK for own filter: got %d, want %d", subAck.Data[2], 1)
+	}
+	if subAck := c.subscribe(2, "devices/ignored/#", 1); subAck.Data[2] != subAckFailure {
+		t.Errorf("SUBACK for foreign filter: got %d, want %d", subAck.Data[2], subAckFailure)
+	}
+	srv.sessionsLock.Lock()
+	_, found := srv.clients["device-1"]
+	srv.sessionsLock.Unlock()
+	if !found {
+		t.Errorf("Client id from certificate not used")
+	}
+
+	for _, cert := range []struct{ name, certFile, keyFile string }{
+		{"untrusted certificate", rogueCert, rogueKey},
+		{"no certificate", "", ""},
+	} {
+		t.Logf("Connecting with %s", cert.name)
+		c := connect(cert.certFile, cert.keyFile)
+		c.expectClosed()
+		c.close()
+	}
+
+	// The same over WebSocket, where the HTTP server does the handshake.
+	cert, err := tls.LoadX509KeyPair(deviceCert, deviceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, source := range []CertIdentitySource{CertIdentityCommonName, CertIdentityEmail} {
+		wssConfig := *config
+		wssConfig.IdentitySource = source
+		wss, err := newListener(&ListenerConfig{Type: WebSocketListener, Address: "127.0.0.1:0", TLS: &wssConfig})
+		if err != nil {
+			t.Fatalf("newListener: %s", err)
+		}
+		defer wss.Close()
+		go srv.listenAndServe(wss)
+		dialer := &websocket.Dialer{
+			Subprotocols:    []string{"mqtt"},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}},
+		}
+		ws, _, err := dialer.Dial("wss://"+wss.Addr().String(), nil)
+		if err != nil {
+			t.Fatalf("Dial: %s", err)
+		}
+		c := startTestClient(t, newWebSocketConn(ws))
+		defer c.close()
+		c.send(connectMessage("ignored", true))
+		if source == CertIdentityEmail {
+			// The certificate has no e-mail address.
+			c.expectClosed()
+			continue
+		}
+		if connAck := c.receive(); connAck.Data[1] != ConnAccepted {
+			t.Fatalf("wss CONNACK: got %d, want %d", connAck.Data[1], ConnAccepted)
+		}
+		if subAck := c.subscribe(1, "devices/device-1/#", 1); subAck.Data[2] != 1 {
+			t.Errorf("wss SUBACK for own filter: got %d, want %d", subAck.Data[2], 1)
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	srv := New(Config{})
+	listener, err := newListener(&ListenerConfig{
+		Type:      WebSocketListener,
+		Address:   "127.0.0.1:0",
+		WebSocket: &WebSocketConfig{Path: "/mqtt"},
+	})
+	if err != nil {
+		t.Fatalf("newListener: %s", err)
+	}
+	defer listener.Close()
+	go srv.listenAndServe(listener)
+	url := "ws://" + listener.Addr().String() + "/mqtt"
+
+	dialer := &websocket.Dialer{Subprotocols: []string{"mqtt"}}
+	ws, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	browser := startTestClient(t, newWebSocketConn(ws))
+	defer browser.close()
+	browser.send(connectMessage("browser", true))
+	if connAck := browser.receive(); connAck.Data[1] != ConnAccepted {
+		t.Fatalf("CONNACK: got %d, want %d", connAck.Data[1], ConnAccepted)
+	}
+	browser.subscribe(1, "sensors/#", 0)
+
+	device, _ := newTestClient(t, srv, connectMessage("device", true))
+	defer device.close()
+	device.subscribe(1, "commands/#", 0)
+	device.publish("sensors/temperature", "21.5", 0)
+	if got := browser.receivePayload(); got != "21.5" {
+		t.Errorf("WebSocket client: got payload %q, want %q", got, "21.5")
+	}
+	browser.publish("commands/heater", "on", 0)
+	if got := device.receivePayload(); got != "on" {
+		t.Errorf("TCP client: got payload %q, want %q", got, "on")
+	}
+
+	// [MQTT-6.0.0-3]
+	ws, _, err = (&websocket.Dialer{}).Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	noSubprotocol := startTestClient(t, newWebSocketConn(ws))
+	defer noSubprotocol.close()
+	noSubprotocol.expectClosed()
+
+	if _, _, err := dialer.Dial("ws://"+listener.Addr().String()+"/other", nil); err == nil {
+		t.Errorf("Dial to wrong path succeeded")
+	}
+}
+
+func TestWebSocketMaximumPacketSize(t *testing.T) {
+	srv := New(Config{MaximumPacketSize: 100})
+	listener, err := newListener(&ListenerConfig{Type: WebSocketListener, Address: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("newListener: %s", err)
+	}
+	defer listener.Close()
+	go srv.listenAndServe(listener)
+
+	ws, _, err := (&websocket.Dialer{Subprotocols: []string{"mqtt"}}).Dial("ws://"+listener.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	c := startTestClient(t, newWebSocketConn(ws))
+	defer c.close()
+	c.send(connectMessageV5("c", true, nil))
+	c.receive()
+
+	// The limit applies to packets, not to WebSocket messages.
+	pings := bytes.Repeat([]byte{byte(messages.PingReq) << 4, 0}, 60)
+	if err := ws.WriteMessage(websocket.BinaryMessage, pings); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	for i := 0; i < 60; i++ {
+		if msg := c.receive(); msg.Type != messages.PingResp {
+			t.Fatalf("Expected PINGRESP, got %+v", msg)
+		}
+	}
+	c.publishV5("t", strings.Repeat("x", 100), 0, nil)
+	if msg := c.receive(); msg.Type != messages.Disconnect || msg.Data[0] != ReasonPacketTooLarge {
+		t.Errorf("Expected DISCONNECT with reason 0x%02x, got %+v", ReasonPacketTooLarge, msg)
+	}
+	c.expectClosed()
+}
+
+func TestListeners(t *testing.T) {
+	aclPath := writeTempFile(t, "topic readwrite public/#\n")
+	defer os.Remove(aclPath)
+	acl, err := NewACLFile(aclPath)
+	if err != nil {
+		t.Fatalf("NewACLFile: %s", err)
+	}
+	srv := New(Config{Listeners: []*ListenerConfig{
+		{Type: TCPListener, Address: "127.0.0.1:0"},
+		{Type: TCPListener, Address: "127.0.0.1:0", MaxConnections: 1, Authorizer: acl},
+	}})
+	if err := srv.listen(); err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	internal := srv.listeners[0].Addr().String()
+	restricted := srv.listeners[1].Addr().String()
+
+	dial := func(address, clientId string) *testClient {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatalf("Dial: %s", err)
+		}
+		c := startTestClient(t, conn)
+		c.send(connectMessage(clientId, true))
+		return c
+	}
+
+	sub := dial(internal, "sub")
+	defer sub.close()
+	sub.receive()
+	if subAck := sub.subscribe(1, "private/#", 0); subAck.Data[2] != 0 {
+		t.Errorf("SUBACK on unrestricted listener: got %d, want %d", subAck.Data[2], 0)
+	}
+
+	pub := dial(restricted, "pub")
+	defer pub.close()
+	pub.receive()
+	if subAck := pub.subscribe(1, "private/#", 0); subAck.Data[2] != subAckFailure {
+		t.Errorf("SUBACK on restricted listener: got %d, want %d", subAck.Data[2], subAckFailure)
+	}
+	sub.subscribe(2, "public/#", 0)
+	pub.publish("private/a", "forbidden", 0)
+	pub.publish("public/a", "shared", 0)
+	if got := sub.receivePayload(); got != "shared" {
+		t.Errorf("Got payload %q, want %q", got, "shared")
+	}
+
+	// Connection limit
+	tooMany := dial(restricted, "tooMany")
+	defer tooMany.close()
+	tooMany.expectClosed()
+
+	srv.closeListeners()
+	if conn, err := net.Dial("tcp", internal); err == nil {
+		conn.Close()
+		t.Errorf("Dial after closeListeners succeeded")
+	}
+}
+
+// recordingAuthenticator accepts all clients and remembers the last one.
+type recordingAuthenticator struct {
+	lock sync.Mutex
+	info *ClientInfo
+}
+
+func (a *recordingAuthenticator) Authenticate(info *ClientInfo) byte {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.info = info
+	return ConnAccepted
+}
+
+func TestUnixListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqttlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mqttlite.sock")
+
+	// Leave a stale socket behind
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	auth := &recordingAuthenticator{}
+	srv := New(Config{Authenticator: auth, Listeners: []*ListenerConfig{
+		{Type: UnixListener, Address: path, Unix: &UnixSocketConfig{Mode: 0600, Uid: -1, Gid: -1}},
+	}})
+	if err := srv.listen(); err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer srv.closeListeners()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Socket mode: got %v, %v, want %v", fi.Mode().Perm(), err, os.FileMode(0600))
+	}
+	if _, err := newListener(&ListenerConfig{Type: UnixListener, Address: path}); err == nil {
+		t.Errorf("Listening on socket in use succeeded")
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	c := startTestClient(t, conn)
+	defer c.close()
+	c.send(connectMessage("local", true))
+	if connAck := c.receive(); connAck.Data[1] != ConnAccepted {
+		t.Fatalf("CONNACK: got %d, want %d", connAck.Data[1], ConnAccepted)
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+	cred := auth.info.PeerCredentials
+	if cred == nil || cred.Uid != os.Getuid() || cred.Gid != os.Getgid() || cred.Pid != os.Getpid() {
+		t.Errorf("PeerCredentials: got %+v, want uid %d, gid %d, pid %d", cred, os.Getuid(), os.Getgid(), os.Getpid())
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command, family byte, addresses ...byte) string {
+		header := append([]byte{}, proxyV2Signature...)
+		header = append(header, 0x20|command, family, 0, byte(len(addresses)))
+		return string(append(header, addresses...))
+	}
+	tests := []struct {
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 5555 1883\r\n", "203.0.113.7:5555", false},
+		{"PROXY TCP6 2001:db8::7 2001:db8::1 5555 1883\r\n", "[2001:db8::7]:5555", false},
+		{"PROXY UNKNOWN\r\n", "", false},
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 5555\r\n", "", true},
+		{"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n", "", true},
+		{v2(1, 0x11, 203, 0, 113, 7, 10, 0, 0, 1, 0x15, 0xb3, 0x07, 0x5b), "203.0.113.7:5555", false},
+		{v2(1, 0x21, append(append(net.ParseIP("2001:db8::7"), net.ParseIP("2001:db8::1")...), 0x15, 0xb3, 0x07, 0x5b)...), "[2001:db8::7]:5555", false},
+		{v2(0, 0x00), "", false},
+		{v2(1, 0x11, 1, 2), "", true},
+		{"\x10\x0c\x00\x04MQTT\x04\x02\x00\x3c", "", true},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.header + "rest"))
+		addr, err := readProxyHeader(r)
+		if (err != nil) != test.wantErr {
+			t.Errorf("readProxyHeader(%q): got error %v, want error: %t", test.header, err, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != test.want {
+			t.Errorf("readProxyHeader(%q): got %q, want %q", test.header, got, test.want)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "rest" {
+			t.Errorf("readProxyHeader(%q): %q left, want %q", test.header, rest, "rest")
+		}
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	auth := &recordingAuthenticator{}
+	srv := New(Config{Authenticator: auth, Listeners: []*ListenerConfig{
+		{Type: TCPListener, Address: "127.0.0.1:0", ProxyProtocol: true, MaxConnectionsPerHost: 1},
+	}})
+	if err := srv.listen(); err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer srv.closeListeners()
+	address := srv.listeners[0].Addr().String()
+
+	dial := func(clientAddr string, clientId string) *testClient {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatalf("Dial: %s", err)
+		}
+		host, port, _ := net.SplitHostPort(clientAddr)
+		fmt.Fprintf(conn, "PROXY TCP4 %s 127.0.0.1 %s 1883\r\n", host, port)
+		c := startTestClient(t, conn)
+		c.send(connectMessage(clientId, true))
+		return c
+	}
+
+	first := dial("203.0.113.7:5555", "first")
+	defer first.close()
+	first.receive()
+	auth.lock.Lock()
+	if got := auth.info.RemoteAddr.String(); got != "203.0.113.7:5555" {
+		t.Errorf("RemoteAddr: got %s, want %s", got, "203.0.113.7:5555")
+	}
+	auth.lock.Unlock()
+
+	// The limit applies to the client's address, not the proxy's
+	sameHost := dial("203.0.113.7:5556", "sameHost")
+	defer sameHost.close()
+	sameHost.expectClosed()
+	otherHost := dial("203.0.113.8:5555", "otherHost")
+	defer otherHost.close()
+	if connAck := otherHost.receive(); connAck.Data[1] != ConnAccepted {
+		t.Errorf("CONNACK: got %d, want %d", connAck.Data[1], ConnAccepted)
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	got, err := ParseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+	want := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseCipherSuites: got %v, %v, want %v", got, err, want)
+	}
+	if _, err := ParseCipherSuites("TLS_BOGUS"); err == nil {
+		t.Errorf("ParseCipherSuites(\"TLS_BOGUS\"): expected error")
+	}
+}
+
+func connectMessageV5(clientId string, cleanStart bool, props *messages.Properties) *messages.Message {
+	var flags uint8
+	if cleanStart {
+		flags |= 2
+	}
+	msg := &messages.Message{Type: messages.Connect, Flags: 0, Data: []byte{}}
+	pw := msg.PayloadWriter()
+	pw.WriteString("MQTT")
+	pw.WriteUint8(5)
+	pw.WriteUint8(flags)
+	pw.WriteUint16(60)
+	pw.WriteProperties(props)
+	pw.WriteString(clientId)
+	return msg
+}
+
+func connectMessageV5WithWill(clientId string, willTopic TopicName, willMessage string) *messages.Message {
+	msg := connectMessageV5(clientId, true, nil)
+	msg.Data[7] |= 4
+	pw := msg.PayloadWriter()
+	pw.WriteProperties(nil)
+	pw.WriteString(string(willTopic))
+	pw.WriteString(willMessage)
+	return msg
+}
+
+// subscribeV5 sends a MQTT 5 SUBSCRIBE message for filter and returns the
+// SUBACK's reason codes.
+func (c *testClient) subscribeV5(packetId uint16, filter TopicFilter, options uint8) []byte {
+	msg := &messages.Message{Type: messages.Subscribe, Flags: 2, Data: []byte{}}
+	pw := msg.PayloadWriter()
+	pw.WriteUint16(packetId)
+	pw.WriteProperties(nil)
+	pw.WriteString(string(filter))
+	pw.WriteUint8(options)
+	c.send(msg)
+	subAck := c.receive()
+	if subAck.Type != messages.SubAck {
+		c.t.Fatalf("Expected SUBACK, got %+v", subAck)
+	}
+	pr := subAck.PayloadReader(2)
+	if _, err := pr.GetProperties(); err != messages.ErrNone {
+		c.t.Fatalf("SUBACK: invalid properties")
+	}
+	return subAck.Data[pr.GetCurPos():]
+}
+
+// publishV5 sends a MQTT 5 PUBLISH message and, for QoS > 0, returns the
+// reason code of the PUBACK or PUBREC.
+func (c *testClient) publishV5(topic TopicName, payload string, qos uint8, props *messages.Properties) byte {
+	msg := &messages.Message{Type: messages.Publish, Flags: qos << 1, Data: []byte{}}
+	pw := msg.PayloadWriter()
+	pw.WriteString(string(topic))
+	if qos > 0 {
+		pw.WriteUint16(1)
+	}
+	pw.WriteProperties(props)
+	pw.WriteBytes([]byte(payload))
+	c.send(msg)
+	if qos == 0 {
+		return ReasonSuccess
+	}
+	ack := c.receive()
+	if len(ack.Data) < 3 {
+		return ReasonSuccess
+	}
+	return ack.Data[2]
+}
+
+func parsePublishV5(t *testing.T, msg *messages.Message) (receivedPublish, *messages.Properties) {
+	if msg.Type != messages.Publish {
+		t.Fatalf("Expected PUBLISH, got %+v", msg)
+	}
+	pr := msg.PayloadReader(0)
+	pr.GetString()
+	if (msg.Flags>>1)&3 > 0 {
+		pr.GetUint16()
+	}
+	props, err := pr.GetProperties()
+	if err != messages.ErrNone {
+		t.Fatalf("PUBLISH: invalid properties")
+	}
+	return receivedPublish{
+		dup:     msg.Flags&8 > 0,
+		qos:     (msg.Flags >> 1) & 3,
+		payload: string(msg.Data[pr.GetCurPos():]),
+	}, props
+}
+
+func TestMQTT5Connect(t *testing.T) {
+	srv := New(Config{})
+
+	c, connAck := newTestClient(t, srv, connectMessageV5("", true, nil))
+	defer c.close()
+	if connAck.Data[1] != ReasonSuccess {
+		t.Fatalf("CONNACK: got reason code 0x%02x, want 0x00", connAck.Data[1])
+	}
+	pr := connAck.PayloadReader(2)
+	props, err := pr.GetProperties()
+	if err != messages.ErrNone {
+		t.Fatalf("CONNACK: invalid properties")
+	}
+	if !strings.HasPrefix(props.AssignedClientIdentifier, "mqttlite-") {
+		t.Errorf("CONNACK: got assigned client id %q", props.AssignedClientIdentifier)
+	}
+
+	unsupported := connectMessageV5("c2", true, nil)
+	unsupported.Data[6] = 6
+	// Payload Format Indicator must be 0 or 1
+	invalid := &messages.Message{Type: messages.Connect, Flags: 0, Data: []byte{0, 4, 'M', 'Q', 'T', 'T', 5, 2, 0, 60, 2, messages.PropPayloadFormatIndicator, 5, 0, 0}}
+	tests := []struct {
+		name    string
+		connect *messages.Message
+		want    []byte
+	}{
+		{"auth method", connectMessageV5("c1", true, &messages.Properties{AuthenticationMethod: "FOO"}), []byte{0, ReasonBadAuthenticationMethod, 0}},
+		{"unsupported version", unsupported, []byte{0, ConnRefusedUnacceptableProtocolVersion}},
+		{"invalid properties", invalid, []byte{0, ReasonProtocolError, 0}},
+	}
+	for _, test := range tests {
+		c, connAck := newTestClient(t, srv, test.connect)
+		if !reflect.DeepEqual(connAck.Data, test.want) {
+			t.Errorf("%s: got CONNACK %v, want %v", test.name, connAck.Data, test.want)
+		}
+		c.expectClosed()
+	}
+}
+
+func TestMQTT5Interop(t *testing.T) {
+	srv := New(Config{})
+	v5, _ := newTestClient(t, srv, connectMessageV5("v5", true, nil))
+	defer v5.close()
+	v3, _ := newTestClient(t, srv, connectMessage("v3", true))
+	defer v3.close()
+
+	if got := v5.subscribeV5(1, "t", 1); !reflect.DeepEqual(got, []byte{1}) {
+		t.Fatalf("v5 SUBACK: got %v, want [1]", got)
+	}
+	v3.subscribe(1, "t", 1)
+
+	// Both clients get all messages, including their own.
+	for _, c := range []struct {
+		name    string
+		publish func(payload string)
+	}{
+		{"v5", func(payload string) { v5.publishV5("t", payload, 0, nil) }},
+		{"v3", func(payload string) { v3.publish("t", payload, 0) }},
+	} {
+		payload := "from " + c.name
+		c.publish(payload)
+		if got, _ := parsePublishV5(t, v5.receive()); got.payload != payload {
+			t.Errorf("v5 client: got payload %q, want %q", got.payload, payload)
+		}
+		if got := v3.receivePayload(); got != payload {
+			t.Errorf("v3 client: got payload %q, want %q", got, payload)
+		}
+	}
+}
+
+func TestMQTT5ReasonCodes(t *testing.T) {
+	path := writeTempFile(t, "topic #\ntopic read $SYS/#\n")
+	defer os.Remove(path)
+	acl, err := NewACLFile(path)
+	if err != nil {
+		t.Fatalf("NewACLFile: %s", err)
+	}
+	srv := New(Config{Authorizer: acl})
+	c, _ := newTestClient(t, srv, connectMessageV5("client", true, nil))
+	defer c.close()
+
+	subscribeTests := []struct {
+		filter TopicFilter
+		want   byte
+	}{
+		{"a/b", 1},
+		{"a/#/b", ReasonTopicFilterInvalid},
+		{"$SYS/#", 1},
+		{"$private", ReasonNotAuthorized},
+	}
+	for i, test := range subscribeTests {
+		// No Local, so PUBACKs are not preceded by the client's own messages
+		if got := c.subscribeV5(uint16(i+1), test.filter, 1|4); !reflect.DeepEqual(got, []byte{test.want}) {
+			t.Errorf("SUBACK for %q: got %v, want [0x%02x]", test.filter, got, test.want)
+		}
+	}
+
+	other, _ := newTestClient(t, srv, connectMessage("other", true))
+	defer other.close()
+	other.subscribe(1, "a/b", 0)
+
+	publishTests := []struct {
+		topic TopicName
+		want  byte
+	}{
+		{"a/b", ReasonSuccess},
+		{"nobody/listens", ReasonNoMatchingSubscribers},
+		{"$SYS/x", ReasonNotAuthorized},
+	}
+	for _, test := range publishTests {
+		if got := c.publishV5(test.topic, "x", 1, nil); got != test.want {
+			t.Errorf("PUBACK for %q: got 0x%02x, want 0x%02x", test.topic, got, test.want)
+		}
+	}
+
+	unsubscribe := &messages.Message{Type: messages.Unsubscribe, Flags: 2, Data: []byte{}}
+	pw := unsubscribe.PayloadWriter()
+	pw.WriteUint16(10)
+	pw.WriteProperties(nil)
+	pw.WriteString("a/b")
+	pw.WriteString("never/subscribed")
+	c.send(unsubscribe)
+	unsubAck := c.receive()
+	if want := []byte{0, 10, 0, ReasonSuccess, ReasonNoSubscriptionExisted}; !reflect.DeepEqual(unsubAck.Data, want) {
+		t.Errorf("UNSUBACK: got %v, want %v", unsubAck.Data, want)
+	}
+}
+
+func TestMQTT5DisconnectWithWill(t *testing.T) {
+	srv := New(Config{})
+	observer, _ := newTestClient(t, srv, connectMessage("observer", true))
+	defer observer.close()
+	observer.subscribe(1, "will", 0)
+
+	for _, reason := range []byte{ReasonSuccess, ReasonDisconnectWithWill} {
+		c, _ := newTestClient(t, srv, connectMessageV5WithWill("client", "will", "gone"))
+		c.send(&messages.Message{Type: messages.Disconnect, Flags: 0, Data: []byte{reason, 0}})
+		c.expectClosed()
+	}
+	// Only the second disconnect publishes the will.
+	if got := observer.receivePayload(); got != "gone" {
+		t.Errorf("Will message: got payload %q, want %q", got, "gone")
+	}
+	observer.ping()
+}
+
+// receiveShared reads a PUBLISH message and, if ack is true, acknowledges it.
+func (c *testClient) receiveShared(ack bool) string {
+	msg := c.receive()
+	got := parsePublish(c.t, msg)
+	if ack && got.qos == 1 {
+		pr := msg.PayloadReader(0)
+		pr.GetString()
+		puback := &messages.Message{Type: messages.PubAck, Flags: 0, Data: []byte{}}
+		puback.PayloadWriter().WriteUint16(pr.GetUint16())
+		c.send(puback)
+	}
+	return got.payload
+}
+
+func TestSharedSubscriptions(t *testing.T) {
+	tests := []struct {
+		strategy ShareStrategy
+		acks     []bool   // whether members a and b acknowledge messages
+		want     []string // member that receives each message
+	}{
+		{RoundRobin, []bool{true, true}, []string{"a", "b", "a", "b"}},
+		{RoundRobin, []bool{false, true}, []string{"a", "b", "a", "b"}},
+		{LeastInflight, []bool{true, true}, []string{"a", "b", "a", "b"}},
+		{LeastInflight, []bool{false, true}, []string{"a", "b", "b", "b"}},
+	}
+	for _, test := range tests {
+		srv := New(Config{SharedSubscriptionStrategy: test.strategy})
+		pub, _ := newTestClient(t, srv, connectMessage("pub", true))
+		pub.publishWithRetain("t", "retained", 0, true)
+		members := make(map[string]*testClient)
+		for _, id := range []string{"b", "a"} {
+			c, _ := newTestClient(t, srv, connectMessage(id, true))
+			c.subscribe(1, "$share/g/t", 1)
+			members[id] = c
+		}
+		all, _ := newTestClient(t, srv, connectMessage("all", true))
+		all.subscribe(1, "t", 0)
+		all.receivePayload() // retained message
+
+		for i, want := range test.want {
+			payload := fmt.Sprintf("msg %d", i)
+			pub.publish("t", payload, 1)
+			ack := test.acks[0]
+			if want == "b" {
+				ack = test.acks[1]
+			}
+			if got := members[want].receiveShared(ack); got != payload {
+				t.Errorf("Strategy %d, acks %v: member %s got %q, want %q", test.strategy, test.acks, want, got, payload)
+			}
+			if got := all.receivePayload(); got != payload {
+				t.Errorf("Non-shared subscriber got %q, want %q", got, payload)
+			}
+		}
+		// Closing a member hands its unacknowledged messages to the others,
+		// so check all of them first.
+		for _, c := range members {
+			c.ping() // no retained or unexpected messages
+		}
+		for _, c := range members {
+			c.close()
+		}
+		all.close()
+		pub.close()
+	}
+}
+
+func TestSharedSubscriptionMemberDisconnect(t *testing.T) {
+	srv := New(Config{})
+	pub, _ := newTestClient(t, srv, connectMessage("pub", true))
+	defer pub.close()
+	a, _ := newTestClient(t, srv, connectMessage("a", true))
+	a.subscribe(1, "$share/g/t", 1)
+	b, _ := newTestClient(t, srv, connectMessage("b", true))
+	defer b.close()
+	b.subscribe(1, "$share/g/t", 1)
+
+	pub.publish("t", "for a", 1)
+	pub.publish("t", "for b", 1)
+	if got := a.receiveShared(false); got != "for a" {
+		t.Errorf("Member a: got %q, want %q", got, "for a")
+	}
+	if got := b.receiveShared(true); got != "for b" {
+		t.Errorf("Member b: got %q, want %q", got, "for b")
+	}
+
+	// a leaves without acknowledging, so b gets the message.
+	a.close()
+	if got := b.receiveShared(true); got != "for a" {
+		t.Errorf("Member b: got %q, want %q", got, "for a")
+	}
+	pub.publish("t", "only b", 1)
+	if got := b.receiveShared(true); got != "only b" {
+		t.Errorf("Member b: got %q, want %q", got, "only b")
+	}
+}
+
+func TestSharedSubscriptionFileStoreRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqttlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions.log")
+
+	store, err := NewFileStore(path, 0)
+	if err != nil {
+		t.Fatalf("NewFileStore: %s", err)
+	}
+	config := Config{DefaultSessionExpiry: time.Hour, SessionStore: store}
+	srv := New(config)
+	a, _ := newTestClient(t, srv, connectMessage("a", false))
+	a.subscribe(1, "$share/g/t", 1)
+	pub, _ := newTestClient(t, srv, connectMessage("pub", true))
+	pub.publish("t", "in flight", 1)
+	a.receiveShared(false)
+	a.close()
+	waitOffline(t, srv, "a")
+	pub.close()
+	store.Close()
+
+	// Restart
+	store, err = NewFileStore(path, 0)
+	if err != nil {
+		t.Fatalf("NewFileStore: %s", err)
+	}
+	defer store.Close()
+	config.SessionStore = store
+	srv = New(config)
+	if err := srv.loadSessions(); err != nil {
+		t.Fatalf("loadSessions: %s", err)
+	}
+	b, _ := newTestClient(t, srv, connectMessage("b", true))
+	defer b.close()
+	b.subscribe(1, "$share/g/t", 1)
+
+	// a's message still belongs to the group, so b gets it when a expires.
+	srv.sessionsLock.Lock()
+	state := srv.persistentSessions["a"]
+	srv.sessionsLock.Unlock()
+	srv.expireSession(state, time.Now().Add(2*time.Hour))
+	if got := b.receiveShared(true); got != "in flight" {
+		t.Errorf("Member b: got %q, want %q", got, "in flight")
+	}
+	b.ping()
+}
+
+func TestMessageExpiry(t *testing.T) {
+	srv := New(Config{DefaultMessageTTL: 200 * time.Millisecond})
+	sub, _ := newTestClient(t, srv, connectMessage("sub", false))
+	sub.subscribe(1, "t", 1)
+	v5, _ := newTestClient(t, srv, connectMessageV5("v5", true, nil))
+	defer v5.close()
+	v5.subscribeV5(1, "t", 1)
+	pub, _ := newTestClient(t, srv, connectMessage("pub", true))
+	defer pub.close()
+
+	// Delivered while the subscriber is online, but not acknowledged.
+	pub.publishWithRetain("t", "in flight", 1, true)
+	sub.receivePayload()
+	got, props := parsePublishV5(t, v5.receive())
+	if got.payload != "in flight" || props.MessageExpiryInterval == nil || *props.MessageExpiryInterval != 1 {
+		t.Errorf("v5 client: got %+v with properties %+v, want message expiry interval 1", got, props)
+	}
+	sub.close()
+	waitOffline(t, srv, "sub")
+	pub.publish("t", "queued", 1)
+	v5.receive()
+
+	time.Sleep(300 * time.Millisecond)
+	sub, connAck := newTestClient(t, srv, connectMessage("sub", false))
+	defer sub.close()
+	if connAck.Data[0] != 1 {
+		t.Errorf("CONNACK: got session present %d, want 1", connAck.Data[0])
+	}
+	sub.ping() // neither resent nor queued messages
+
+	v3, _ := newTestClient(t, srv, connectMessage("v3", true))
+	defer v3.close()
+	v3.subscribe(1, "t", 1)
+	v3.ping() // no retained message
+
+	// MQTT 5 clients set the expiry themselves
+	retain := &messages.Message{Type: messages.Publish, Flags: 1, Data: []byte{}}
+	pw := retain.PayloadWriter()
+	pw.WriteString("r")
+	pw.WriteProperties(&messages.Properties{MessageExpiryInterval: messages.Uint32(60)})
+	pw.WriteBytes([]byte("retained"))
+	v5.send(retain)
+	v5.ping()
+	late, _ := newTestClient(t, srv, connectMessageV5("late", true, nil))
+	defer late.close()
+	late.subscribeV5(1, "r", 0)
+	got, props = parsePublishV5(t, late.receive())
+	if got.payload != "retained" || props.MessageExpiryInterval == nil || *props.MessageExpiryInterval > 60 || *props.MessageExpiryInterval < 59 {
+		t.Errorf("Retained message: got %+v with properties %+v, want message expiry interval 60", got, props)
+	}
+}
+
+func TestTopicAliases(t *testing.T) {
+	srv := New(Config{TopicAliasMaximum: 2})
+	sub, connAck := newTestClient(t, srv, connectMessageV5("sub", true, &messages.Properties{TopicAliasMaximum: 2}))
+	defer sub.close()
+	pr := connAck.PayloadReader(2)
+	if props, _ := pr.GetProperties(); props.TopicAliasMaximum != 2 {
+		t.Errorf("CONNACK: got topic alias maximum %d, want 2", props.TopicAliasMaximum)
+	}
+	sub.subscribeV5(1, "#", 0)
+
+	pub, _ := newTestClient(t, srv, connectMessageV5("pub", true, nil))
+	defer pub.close()
+	publish := func(topic TopicName, alias uint16, payload string) {
+		pub.publishV5(topic, payload, 0, &messages.Properties{TopicAlias: alias})
+	}
+
+	// Inbound: the subscriber gets the full topic names, outbound: least
+	// recently used aliases are reassigned.
+	publish("a", 1, "a")
+	publish("b", 2, "b")
+	publish("", 1, "a")
+	publish("c", 0, "c")
+	publish("", 2, "b")
+	want := []struct {
+		topic   TopicName
+		alias   uint16
+		payload string
+	}{
+		{"a", 1, "a"},
+		{"b", 2, "b"},
+		{"", 1, "a"},
+		{"c", 2, "c"},
+		{"b", 1, "b"},
+	}
+	for _, w := range want {
+		msg := sub.receive()
+		topic := TopicName(msg.PayloadReader(0).GetString())
+		got, props := parsePublishV5(t, msg)
+		if topic != w.topic || props.TopicAlias != w.alias || got.payload != w.payload {
+			t.Errorf("Got topic %q, alias %d, payload %q; want %q, %d, %q", topic, props.TopicAlias, got.payload, w.topic, w.alias, w.payload)
+		}
+	}
+
+	tests := []struct {
+		topic TopicName
+		alias uint16
+		want  byte
+	}{
+		{"x", 3, ReasonTopicAliasInvalid},
+		{"", 2, ReasonProtocolError},
+		{"", 0, ReasonProtocolError},
+	}
+	for _, test := range tests {
+		c, _ := newTestClient(t, srv, connectMessageV5("c", true, nil))
+		c.publishV5(test.topic, "x", 0, &messages.Properties{TopicAlias: test.alias})
+		if msg := c.receive(); msg.Type != messages.Disconnect || msg.Data[0] != test.want {
+			t.Errorf("Topic %q, alias %d: got %+v, want DISCONNECT 0x%02x", test.topic, test.alias, msg, test.want)
+		}
+		c.expectClosed()
+	}
+}
+
+func TestSubscriptionOptions(t *testing.T) {
+	for _, options := range []uint8{0, 1, 2, 4 | 1, 8 | 2, 0x10, 0x20 | 8 | 4 | 1} {
+		if got := newSubscription("t", options).options(); got != options {
+			t.Errorf("newSubscription(%#x).options(): got %#x", options, got)
+		}
+	}
+
+	srv := New(Config{})
+	pub, _ := newTestClient(t, srv, connectMessageV5("pub", true, nil))
+	defer pub.close()
+	retain := &messages.Message{Type: messages.Publish, Flags: 1, Data: []byte{}}
+	pw := retain.PayloadWriter()
+	pw.WriteString("r")
+	pw.WriteProperties(nil)
+	pw.WriteBytes([]byte("retained"))
+	pub.send(retain)
+	pub.ping()
+
+	// No Local
+	pub.subscribeV5(1, "local", 4)
+	pub.subscribeV5(2, "local/all", 0)
+	pub.publishV5("local", "not for me", 0, nil)
+	pub.publishV5("local/all", "for me", 0, nil)
+	if got, _ := parsePublishV5(t, pub.receive()); got.payload != "for me" {
+		t.Errorf("No Local: got payload %q, want %q", got.payload, "for me")
+	}
+
+	// Retain Handling
+	c, _ := newTestClient(t, srv, connectMessageV5("c", true, nil))
+	defer c.close()
+	tests := []struct {
+		filter  TopicFilter
+		options uint8
+		want    bool // whether the retained message is sent
+	}{
+		{"r", 0x00, true},
+		{"r", 0x00, true},
+		{"r", 0x10, false}, // exists already
+		{"+", 0x10, true},
+		{"#", 0x20, false},
+	}
+	for i, test := range tests {
+		c.subscribeV5(uint16(i+1), test.filter, test.options)
+		if test.want {
+			if got, _ := parsePublishV5(t, c.receive()); got.payload != "retained" {
+				t.Errorf("Subscription %d: got payload %q, want %q", i, got.payload, "retained")
+			}
+		}
+		c.ping()
+	}
+
+	// Retain As Published
+	rap, _ := newTestClient(t, srv, connectMessageV5("rap", true, nil))
+	defer rap.close()
+	rap.subscribeV5(1, "x", 0x28) // Retain As Published, don't send retained messages
+	v3, _ := newTestClient(t, srv, connectMessage("v3", true))
+	defer v3.close()
+	v3.subscribe(1, "x", 0)
+	retain = &messages.Message{Type: messages.Publish, Flags: 1, Data: []byte{}}
+	pw = retain.PayloadWriter()
+	pw.WriteString("x")
+	pw.WriteBytes([]byte("retained"))
+	v3.send(retain)
+	if msg := rap.receive(); msg.Flags&1 != 1 {
+		t.Errorf("Retain As Published: got flags %d, want RETAIN", msg.Flags)
+	}
+	if msg := v3.receive(); msg.Flags&1 != 0 {
+		t.Errorf("Without Retain As Published: got flags %d, want no RETAIN", msg.Flags)
+	}
+
+	// No Local is not allowed for shared subscriptions
+	shared, _ := newTestClient(t, srv, connectMessageV5("shared", true, nil))
+	msg := &messages.Message{Type: messages.Subscribe, Flags: 2, Data: []byte{}}
+	pw = msg.PayloadWriter()
+	pw.WriteUint16(1)
+	pw.WriteProperties(nil)
+	pw.WriteString("$share/g/t")
+	pw.WriteUint8(4)
+	shared.send(msg)
+	if got := shared.receive(); got.Type != messages.Disconnect || got.Data[0] != ReasonProtocolError {
+		t.Errorf("No Local on shared subscription: got %+v, want DISCONNECT 0x82", got)
+	}
+	shared.expectClosed()
+}
+
+func TestPropertyPassthrough(t *testing.T) {
+	srv := New(Config{})
+	sub, _ := newTestClient(t, srv, connectMessageV5("sub", true, nil))
+	defer sub.close()
+	sub.subscribeV5(1, "req", 1)
+	v3, _ := newTestClient(t, srv, connectMessage("v3", true))
+	defer v3.close()
+	v3.subscribe(1, "req", 1)
+	offline, _ := newTestClient(t, srv, connectMessageV5("offline", false, &messages.Properties{SessionExpiryInterval: messages.Uint32(60)}))
+	offline.subscribeV5(1, "req", 1)
+	offline.close()
+	waitOffline(t, srv, "offline")
+
+	props := &messages.Properties{
+		PayloadFormatIndicator: 1,
+		ContentType:            "application/json",
+		ResponseTopic:          "resp/client",
+		CorrelationData:        []byte{1, 2, 3},
+		UserProperties:         []messages.UserProperty{{Key: "b", Value: "2"}, {Key: "a", Value: "1"}, {Key: "b", Value: "3"}},
+	}
+	pub, _ := newTestClient(t, srv, connectMessageV5("pub", true, nil))
+	defer pub.close()
+	msg := &messages.Message{Type: messages.Publish, Flags: 1<<1 | 1, Data: []byte{}}
+	pw := msg.PayloadWriter()
+	pw.WriteString("req")
+	pw.WriteUint16(1)
+	pw.WriteProperties(props)
+	pw.WriteBytes([]byte("{}"))
+	pub.send(msg)
+	pub.receive() // PUBACK
+
+	check := func(name string, got *messages.Properties) {
+		got.TopicAlias = 0
+		if !reflect.DeepEqual(got, props) {
+			t.Errorf("%s: got properties %+v, want %+v", name, got, props)
+		}
+	}
+	_, got := parsePublishV5(t, sub.receive())
+	check("Subscriber", got)
+	if got := v3.receivePayload(); got != "{}" {
+		t.Errorf("v3 subscriber: got payload %q, want %q", got, "{}")
+	}
+
+	late, _ := newTestClient(t, srv, connectMessageV5("late", true, nil))
+	defer late.close()
+	late.subscribeV5(1, "req", 1)
+	_, got = parsePublishV5(t, late.receive())
+	check("Retained", got)
+
+	offline, _ = newTestClient(t, srv, connectMessageV5("offline", false, &messages.Properties{SessionExpiryInterval: messages.Uint32(60)}))
+	defer offline.close()
+	_, got = parsePublishV5(t, offline.receive())
+	check("Queued", got)
+
+	om := &outstandingPublishMessage{topic: "req", properties: props}
+	check("Stored", newOutstandingPublishMessageFromStore(om.toStoredMessage()).properties)
+
+	pub.publishV5("req", "", 0, &messages.Properties{ResponseTopic: "resp/+"})
+	if msg := pub.receive(); msg.Type != messages.Disconnect || msg.Data[0] != ReasonProtocolError {
+		t.Errorf("Wildcard response topic: got %+v, want DISCONNECT 0x82", msg)
+	}
+}
+
+func sessionExpiry(secs uint32) *messages.Properties {
+	return &messages.Properties{SessionExpiryInterval: &secs}
+}
+
+// disconnectSession sends DISCONNECT with payload data and waits until the
+// server has terminated the client's session.
+func disconnectSession(c *testClient, srv *Server, clientId string, data []byte) {
+	srv.sessionsLock.Lock()
+	sess := srv.clients[clientId]
+	srv.sessionsLock.Unlock()
+	c.send(&messages.Message{Type: messages.Disconnect, Flags: 0, Data: data})
+	c.expectClosed()
+	<-sess.done
+}
+
+func TestSessionExpiry(t *testing.T) {
+	disconnectWithExpiry := func(secs uint32) []byte {
+		msg := &messages.Message{Type: messages.Disconnect, Flags: 0, Data: []byte{}}
+		pw := msg.PayloadWriter()
+		pw.WriteUint8(ReasonSuccess)
+		pw.WriteProperties(sessionExpiry(secs))
+		return msg.Data
+	}
+	tests := []struct {
+		desc       string
+		ttl        time.Duration // Config.DefaultSessionExpiry
+		connect    *messages.Message
+		disconnect []byte
+		kept       bool          // whether the session is kept after disconnecting
+		expiresIn  time.Duration // 0 if the session never expires
+	}{
+		{"MQTT 5", 0, connectMessageV5("c", true, sessionExpiry(60)), []byte{}, true, time.Minute},
+		{"MQTT 5 never expires", 0, connectMessageV5("c", true, sessionExpiry(0xFFFFFFFF)), []byte{}, true, 0},
+		{"MQTT 5 changed on disconnect", 0, connectMessageV5("c", true, sessionExpiry(60)), disconnectWithExpiry(120), true, 2 * time.Minute},
+		{"MQTT 5 ended on disconnect", 0, connectMessageV5("c", true, sessionExpiry(60)), disconnectWithExpiry(0), false, 0},
+		{"MQTT 5 without expiry", 0, connectMessageV5("c", true, nil), []byte{}, false, 0},
+		{"MQTT 3.1.1 default", time.Hour, connectMessage("c", false), []byte{}, true, time.Hour},
+		{"MQTT 3.1.1 forever", 0, connectMessage("c", false), []byte{}, true, 0},
+	}
+	for _, test := range tests {
+		srv := New(Config{DefaultSessionExpiry: test.ttl, SessionStore: NewMemoryStore()})
+		c, _ := newTestClient(t, srv, test.connect)
+		disconnectSession(c, srv, "c", test.disconnect)
+
+		srv.sessionsLock.Lock()
+		state := srv.persistentSessions["c"]
+		srv.sessionsLock.Unlock()
+		if got := state != nil; got != test.kept {
+			t.Errorf("%s: session kept: got %t, want %t", test.desc, got, test.kept)
+			continue
+		}
+		stored, _ := srv.store.Load()
+		if got := len(stored) > 0; got != test.kept {
+			t.Errorf("%s: session stored: got %t, want %t", test.desc, got, test.kept)
+		}
+		if !test.kept {
+			continue
+		}
+
+		now := time.Now()
+		if test.expiresIn == 0 {
+			srv.expireSession(state, now.Add(100*365*24*time.Hour))
+		} else {
+			srv.expireSession(state, now.Add(test.expiresIn-time.Second))
+			srv.sessionsLock.Lock()
+			_, found := srv.persistentSessions["c"]
+			srv.sessionsLock.Unlock()
+			if !found {
+				t.Errorf("%s: session expired early", test.desc)
+			}
+			srv.expireSession(state, now.Add(test.expiresIn+time.Second))
+		}
+		srv.sessionsLock.Lock()
+		_, found := srv.persistentSessions["c"]
+		srv.sessionsLock.Unlock()
+		if want := test.expiresIn == 0; found != want {
+			t.Errorf("%s: session present after expiry: got %t, want %t", test.desc, found, want)
+		}
+		stored, _ = srv.store.Load()
+		if got := len(stored) > 0; got != found {
+			t.Errorf("%s: session stored after expiry: got %t, want %t", test.desc, got, found)
+		}
+	}
+}
+
+func TestWillDelay(t *testing.T) {
+	reconnect := func(cleanStart bool) func(srv *Server) {
+		return func(srv *Server) {
+			c, _ := newTestClient(t, srv, connectMessageV5("client", cleanStart, sessionExpiry(60)))
+			disconnectSession(c, srv, "client", []byte{})
+		}
+	}
+	expire := func(srv *Server) {
+		srv.sessionsLock.Lock()
+		state := srv.persistentSessions["client"]
+		srv.sessionsLock.Unlock()
+		srv.expireSession(state, time.Now().Add(2*time.Minute))
+	}
+	tests := []struct {
+		desc     string
+		expiry   uint32 // session expiry interval
+		delay    uint32 // will delay interval
+		after    func(srv *Server)
+		wantWill bool
+	}{
+		{"no session expiry", 0, 60, nil, true},
+		{"delay passes", 60, 1, nil, true},
+		{"session expires", 60, 120, expire, true},
+		{"reconnect", 60, 60, reconnect(false), false},
+		{"reconnect with clean start", 60, 60, reconnect(true), true},
+	}
+	for _, test := range tests {
+		srv := New(Config{})
+		observer, _ := newTestClient(t, srv, connectMessage("observer", true))
+		observer.subscribe(1, "will", 0)
+
+		connect := connectMessageV5("client", true, sessionExpiry(test.expiry))
+		connect.Data[7] |= 4
+		pw := connect.PayloadWriter()
+		pw.WriteProperties(&messages.Properties{WillDelayInterval: test.delay})
+		pw.WriteString("will")
+		pw.WriteString("gone")
+		c, _ := newTestClient(t, srv, connect)
+		srv.sessionsLock.Lock()
+		sess := srv.clients["client"]
+		srv.sessionsLock.Unlock()
+		c.close() // lose the connection without DISCONNECT
+		<-sess.done
+
+		if test.after != nil {
+			test.after(srv)
+		}
+		if test.wantWill {
+			if got := observer.receivePayload(); got != "gone" {
+				t.Errorf("%s: will: got payload %q, want %q", test.desc, got, "gone")
+			}
+		}
+		srv.sessionsLock.Lock()
+		state := srv.persistentSessions["client"]
+		srv.sessionsLock.Unlock()
+		if state != nil && state.takeDelayedWill() != nil {
+			t.Errorf("%s: will is still pending", test.desc)
+		}
+		observer.ping()
+		observer.close()
+	}
+}
+
+func TestReceiveMaximum(t *testing.T) {
+	tests := []struct {
+		desc    string
+		max     int // Config.ReceiveMaximum
+		connect *messages.Message
+		window  int // messages sent before the first PUBACK
+	}{
+		{"MQTT 3.1.1", 2, connectMessage("sub", true), 2},
+		{"MQTT 3.1.1 without limit", 0, connectMessage("sub", true), 5},
+		{"MQTT 5", 0, connectMessageV5("sub", true, &messages.Properties{ReceiveMaximum: 3}), 3},
+		{"MQTT 5 without receive maximum", 2, connectMessageV5("sub", true, nil), 5},
+	}
+	const total = 5
+	for _, test := range tests {
+		srv := New(Config{ReceiveMaximum: test.max})
+		pub, _ := newTestClient(t, srv, connectMessage("pub", true))
+		sub, _ := newTestClient(t, srv, test.connect)
+		v5 := test.connect.Data[6] == 5
+		if v5 {
+			sub.subscribeV5(1, "t", 1)
+		} else {
+			sub.subscribe(1, "t", 1)
+		}
+		for i := 0; i < total; i++ {
+			// Returns after the PUBACK, which is sent after the message
+			// was delivered.
+			pub.publish("t", fmt.Sprintf("msg %d", i), 1)
+		}
+
+		// receive reads the next PUBLISH and returns its packet id.
+		receive := func(want string) uint16 {
+			msg := sub.receive()
+			var got receivedPublish
+			if v5 {
+				got, _ = parsePublishV5(t, msg)
+			} else {
+				got = parsePublish(t, msg)
+			}
+			if got.payload != want {
+				t.Errorf("%s: got %q, want %q", test.desc, got.payload, want)
+			}
+			pr := msg.PayloadReader(0)
+			pr.GetString()
+			return pr.GetUint16()
+		}
+		var packetIds []uint16
+		for i := 0; i < test.window; i++ {
+			packetIds = append(packetIds, receive(fmt.Sprintf("msg %d", i)))
+		}
+		sub.ping() // nothing more until a message is acknowledged
+		for i := test.window; i < total; i++ {
+			puback := &messages.Message{Type: messages.PubAck, Flags: 0, Data: []byte{}}
+			puback.PayloadWriter().WriteUint16(packetIds[0])
+			sub.send(puback)
+			packetIds = append(packetIds[1:], receive(fmt.Sprintf("msg %d", i)))
+			sub.ping()
+		}
+		sub.close()
+		pub.close()
+	}
+}
+
+func TestMaximumPacketSize(t *testing.T) {
+	srv := New(Config{MaximumPacketSize: 100})
+	large := strings.Repeat("x", 100)
+
+	// Clients sending larger packets are disconnected.
+	c, connAck := newTestClient(t, srv, connectMessageV5("v5", true, nil))
+	pr := connAck.PayloadReader(2)
+	if props, err := pr.GetProperties(); err != messages.ErrNone || props.MaximumPacketSize != 100 {
+		t.Errorf("CONNACK: got maximum packet size %d (error %d), want 100", props.MaximumPacketSize, err)
+	}
+	c.publishV5("t", "small", 0, nil)
+	c.publishV5("t", large, 0, nil)
+	if msg := c.receive(); msg.Type != messages.Disconnect || msg.Data[0] != ReasonPacketTooLarge {
+		t.Errorf("Expected DISCONNECT with reason 0x%02x, got %+v", ReasonPacketTooLarge, msg)
+	}
+	c.expectClosed()
+
+	c, _ = newTestClient(t, srv, connectMessage("v3", true))
+	c.publish("t", large, 0)
+	c.expectClosed()
+
+	// Messages larger than the client's maximum are not sent to it.
+	sub, _ := newTestClient(t, srv, connectMessageV5("sub", true, &messages.Properties{MaximumPacketSize: 50}))
+	defer sub.close()
+	sub.subscribeV5(1, "t", 1)
+	pub, _ := newTestClient(t, srv, connectMessage("pub", true))
+	defer pub.close()
+	for _, payload := range []string{"first", large[:50], "second"} {
+		pub.publish("t", payload, 1)
+	}
+	for _, want := range []string{"first", "second"} {
+		msg := sub.receive()
+		if got, _ := parsePublishV5(t, msg); got.payload != want {
+			t.Errorf("Got %q, want %q", got.payload, want)
+		}
+		if size := msg.Size(); size > 50 {
+			t.Errorf("Got packet of %d bytes, want at most 50", size)
+		}
+	}
+	sub.ping()
+}
+
+func TestScramRFC7677(t *testing.T) {
+	// Example from RFC 7677, section 3.
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	info := &ClientInfo{}
+	e := &scramExchange{
+		info:            info,
+		creds:           newScramCredentials([]byte("pencil"), salt, 4096),
+		username:        "user",
+		gs2Header:       "n,,",
+		clientFirstBare: "n=user,r=rOprNGfwEbeRWgbNEkqO",
+		serverFirst:     "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		nonce:           "rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0",
+	}
+	got, done, err := e.Next([]byte("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="))
+	if err != nil || !done {
+		t.Fatalf("Next: got done %t, error %v", done, err)
+	}
+	if want := "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="; string(got) != want {
+		t.Errorf("Server final message: got %q, want %q", got, want)
+	}
+	if info.Username != "user" {
+		t.Errorf("User name: got %q, want %q", info.Username, "user")
+	}
+}
+
+// scramClientFinal returns the SCRAM-SHA-256 client-final message answering
+// serverFirst, and the server-final message to expect.
+func scramClientFinal(password, clientFirstBare, serverFirst string) (string, string) {
+	var nonce, salt string
+	var iterations int
+	for _, attr := range strings.Split(serverFirst, ",") {
+		switch attr[:2] {
+		case "r=":
+			nonce = attr[2:]
+		case "s=":
+			salt = attr[2:]
+		case "i=":
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	saltBytes, _ := base64.StdEncoding.DecodeString(salt)
+	saltedPassword := pbkdf2.Key([]byte(password), saltBytes, iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	proof := scramHMAC(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	serverSignature := scramHMAC(scramHMAC(saltedPassword, "Server Key"), authMessage)
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof),
+		"v=" + base64.StdEncoding.EncodeToString(serverSignature)
+}
+
+func (c *testClient) sendAuth(reasonCode byte, data string) {
+	msg := &messages.Message{Type: messages.Auth, Flags: 0, Data: []byte{reasonCode}}
+	msg.PayloadWriter().WriteProperties(&messages.Properties{AuthenticationMethod: ScramSHA256, AuthenticationData: []byte(data)})
+	c.send(msg)
+}
+
+// receiveAuthData reads a packet of type typ and returns its reason code and
+// authentication data.
+func (c *testClient) receiveAuthData(typ messages.MessageType) (byte, string) {
+	msg := c.receive()
+	if msg.Type != typ {
+		c.t.Fatalf("Expected packet type %d, got %+v", typ, msg)
+	}
+	pos := uint16(0)
+	if typ == messages.ConnAck {
+		pos = 1
+	}
+	pr := msg.PayloadReader(pos)
+	reasonCode := pr.GetUint8()
+	if pr.AtEnd() {
+		return reasonCode, ""
+	}
+	props, err := pr.GetProperties()
+	if err != messages.ErrNone {
+		c.t.Fatalf("Invalid properties in %+v", msg)
+	}
+	return reasonCode, string(props.AuthenticationData)
+}
+
+func TestEnhancedAuthentication(t *testing.T) {
+	path := writeTempFile(t, fmt.Sprintf("dave:%s\nerin:%s\n", scramHash("secret"), scramHash("other")))
+	defer os.Remove(path)
+	passwords, err := NewPasswordFileAuthenticator(path, false)
+	if err != nil {
+		t.Fatalf("NewPasswordFileAuthenticator: %s", err)
+	}
+	srv := New(Config{
+		Authenticator: passwords,
+		AuthMethods:   map[string]AuthMethod{ScramSHA256: NewScramSHA256(passwords)},
+	})
+
+	// authenticate runs a SCRAM exchange as user, with CONNECT or AUTH
+	// starting it, and returns the final packet's reason code.
+	authenticate := func(c *testClient, start func(clientFirst string), user, password string, final messages.MessageType) byte {
+		clientFirstBare := "n=" + user + ",r=fyko+d2lbbFgONRv9qkxdawL"
+		start("n,," + clientFirstBare)
+		reasonCode, serverFirst := c.receiveAuthData(messages.Auth)
+		if reasonCode != ReasonContinueAuthentication {
+			t.Fatalf("AUTH: got reason code 0x%02x, want 0x%02x", reasonCode, ReasonContinueAuthentication)
+		}
+		clientFinal, serverFinal := scramClientFinal(password, clientFirstBare, serverFirst)
+		c.sendAuth(ReasonContinueAuthentication, clientFinal)
+		reasonCode, got := c.receiveAuthData(final)
+		if reasonCode == ReasonSuccess && got != serverFinal {
+			t.Errorf("Server final message: got %q, want %q", got, serverFinal)
+		}
+		return reasonCode
+	}
+	connect := func(c *testClient) func(string) {
+		return func(clientFirst string) {
+			c.send(connectMessageV5("client", true, &messages.Properties{
+				AuthenticationMethod: ScramSHA256,
+				AuthenticationData:   []byte(clientFirst),
+			}))
+		}
+	}
+	reauth := func(c *testClient) func(string) {
+		return func(clientFirst string) { c.sendAuth(ReasonReAuthenticate, clientFirst) }
+	}
+	dial := func() *testClient {
+		clientConn, serverConn := net.Pipe()
+		go srv.serve(&listener{config: &ListenerConfig{}}, serverConn)
+		return startTestClient(t, clientConn)
+	}
+
+	c := dial()
+	if got := authenticate(c, connect(c), "dave", "wrong", messages.ConnAck); got != ReasonNotAuthorized {
+		t.Errorf("Wrong password: got reason code 0x%02x, want 0x%02x", got, ReasonNotAuthorized)
+	}
+	c.expectClosed()
+
+	// Unknown users get through to the client-final message, always with the
+	// same salt, so they can't be told apart from users with another password.
+	c = dial()
+	if got := authenticate(c, connect(c), "mallory", "secret", messages.ConnAck); got != ReasonNotAuthorized {
+		t.Errorf("Unknown user: got reason code 0x%02x, want 0x%02x", got, ReasonNotAuthorized)
+	}
+	c.expectClosed()
+	saltAndIterations := func(user string) string {
+		c := dial()
+		defer c.close()
+		connect(c)("n,,n=" + user + ",r=fyko+d2lbbFgONRv9qkxdawL")
+		_, serverFirst := c.receiveAuthData(messages.Auth)
+		return strings.SplitN(serverFirst, ",", 2)[1]
+	}
+	if first, second := saltAndIterations("mallory"), saltAndIterations("mallory"); first != second {
+		t.Errorf("Unknown user: got %q, then %q", first, second)
+	}
+	if mallory, trent := saltAndIterations("mallory"), saltAndIterations("trent"); mallory == trent {
+		t.Errorf("Unknown users mallory and trent both got %q", mallory)
+	}
+
+	c = dial()
+	defer c.close()
+	if got := authenticate(c, connect(c), "dave", "secret", messages.ConnAck); got != ReasonSuccess {
+		t.Fatalf("CONNACK: got reason code 0x%02x, want 0x%02x", got, ReasonSuccess)
+	}
+	if got := authenticate(c, reauth(c), "dave", "secret", messages.Auth); got != ReasonSuccess {
+		t.Errorf("Re-authentication: got reason code 0x%02x, want 0x%02x", got, ReasonSuccess)
+	}
+	c.ping()
+	if got := authenticate(c, reauth(c), "erin", "other", messages.Disconnect); got != ReasonNotAuthorized {
+		t.Errorf("Re-authentication as other user: got reason code 0x%02x, want 0x%02x", got, ReasonNotAuthorized)
+	}
+	c.expectClosed()
+
+	// A listener with its own Authenticator doesn't offer the server's
+	// methods.
+	clientConn, serverConn := net.Pipe()
+	go srv.serve(&listener{config: &ListenerConfig{Authenticator: &recordingAuthenticator{}}}, serverConn)
+	c = startTestClient(t, clientConn)
+	connect(c)("n,,n=dave,r=fyko+d2lbbFgONRv9qkxdawL")
+	if reasonCode, _ := c.receiveAuthData(messages.ConnAck); reasonCode != ReasonBadAuthenticationMethod {
+		t.Errorf("Listener with own Authenticator: got reason code 0x%02x, want 0x%02x", reasonCode, ReasonBadAuthenticationMethod)
+	}
+	c.expectClosed()
+}
+
+// parseReasonProperties returns the reason code and properties of a
+// DISCONNECT or CONNACK.
+func parseReasonProperties(t *testing.T, msg *messages.Message) (byte, *messages.Properties) {
+	pos := uint16(0)
+	if msg.Type == messages.ConnAck {
+		pos = 1
+	}
+	pr := msg.PayloadReader(pos)
+	reasonCode := pr.GetUint8()
+	props, err := pr.GetProperties()
+	if err != messages.ErrNone {
+		t.Fatalf("Invalid properties in %+v", msg)
+	}
+	return reasonCode, props
+}
+
+func TestServerDisconnect(t *testing.T) {
+	srv := New(Config{})
+	tests := []struct {
+		name       string
+		props      *messages.Properties
+		msg        *messages.Message
+		wantCode   byte
+		wantReason string
+	}{
+		{"Invalid QoS", nil, &messages.Message{Type: messages.Publish, Flags: 6, Data: []byte{0, 1, 'a'}}, ReasonMalformedPacket, "Invalid QoS 3"},
+		{"Reason string too large", &messages.Properties{MaximumPacketSize: 4}, &messages.Message{Type: messages.Publish, Flags: 6, Data: []byte{0, 1, 'a'}}, ReasonMalformedPacket, ""},
+		{"Second CONNECT", nil, connectMessageV5("c", true, nil), ReasonProtocolError, "Unexpected packet type"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestClient(t, srv, connectMessageV5("c", true, test.props))
+			c.send(test.msg)
+			msg := c.receive()
+			if msg.Type != messages.Disconnect {
+				t.Fatalf("Got %+v, want DISCONNECT", msg)
+			}
+			reasonCode, props := parseReasonProperties(t, msg)
+			if reasonCode != test.wantCode || props.ReasonString != test.wantReason {
+				t.Errorf("Got reason code 0x%02x, reason %q; want 0x%02x, %q", reasonCode, props.ReasonString, test.wantCode, test.wantReason)
+			}
+			c.expectClosed()
+		})
+	}
+}
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		permanent bool
+		want      byte
+	}{
+		{false, ReasonUseAnotherServer},
+		{true, ReasonServerMoved},
+	}
+	for _, test := range tests {
+		srv := New(Config{})
+		v5, _ := newTestClient(t, srv, connectMessageV5("v5", true, nil))
+		v3, _ := newTestClient(t, srv, connectMessage("v3", true))
+		v5.ping()
+		v3.ping()
+
+		srv.Drain("other:1883", test.permanent)
+		msg := v5.receive()
+		if msg.Type != messages.Disconnect {
+			t.Fatalf("Permanent %t: got %+v, want DISCONNECT", test.permanent, msg)
+		}
+		if reasonCode, props := parseReasonProperties(t, msg); reasonCode != test.want || props.ServerReference != "other:1883" {
+			t.Errorf("Permanent %t: got DISCONNECT 0x%02x to %q, want 0x%02x to %q", test.permanent, reasonCode, props.ServerReference, test.want, "other:1883")
+		}
+		v5.expectClosed()
+		v3.expectClosed()
+
+		c, msg := newTestClient(t, srv, connectMessageV5("new", true, nil))
+		if reasonCode, props := parseReasonProperties(t, msg); reasonCode != test.want || props.ServerReference != "other:1883" {
+			t.Errorf("Permanent %t: got CONNACK 0x%02x to %q, want 0x%02x to %q", test.permanent, reasonCode, props.ServerReference, test.want, "other:1883")
+		}
+		c.expectClosed()
+		c, msg = newTestClient(t, srv, connectMessage("new", true))
+		if msg.Data[1] != ConnRefusedServerUnavailable {
+			t.Errorf("Permanent %t: got CONNACK return code %d, want %d", test.permanent, msg.Data[1], ConnRefusedServerUnavailable)
+		}
+		c.expectClosed()
+	}
+}
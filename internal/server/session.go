@@ -19,7 +19,9 @@
 package server
 
 import (
+	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -30,9 +32,52 @@ var (
 	nextSessionId uint32
 )
 
+// Protocol levels of the supported MQTT versions
+const (
+	protocolLevel31  byte = 3
+	protocolLevel311 byte = 4
+	protocolLevel5   byte = 5
+)
+
 type Subscription struct {
 	qos    uint8
 	filter TopicFilter
+
+	// MQTT 5 subscription options [MQTT5-3.8.3.1]
+	noLocal           bool  // don't send messages published by the same client
+	retainAsPublished bool  // keep the RETAIN flag of forwarded messages
+	retainHandling    uint8 // whether retained messages are sent on subscribe
+}
+
+// Values of the Retain Handling subscription option
+const (
+	retainHandlingSend      uint8 = 0 // send retained messages on subscribe
+	retainHandlingSendIfNew uint8 = 1 // only if the subscription is new
+	retainHandlingDontSend  uint8 = 2
+)
+
+// newSubscription creates a subscription from the options byte of a
+// SUBSCRIBE message. For MQTT 3.1.1 clients, options is just the QoS.
+func newSubscription(filter TopicFilter, options uint8) *Subscription {
+	return &Subscription{
+		qos:               options & 3,
+		filter:            filter,
+		noLocal:           options&4 != 0,
+		retainAsPublished: options&8 != 0,
+		retainHandling:    (options >> 4) & 3,
+	}
+}
+
+// options returns the subscription's options byte as sent in SUBSCRIBE.
+func (sub *Subscription) options() uint8 {
+	options := sub.qos | sub.retainHandling<<4
+	if sub.noLocal {
+		options |= 4
+	}
+	if sub.retainAsPublished {
+		options |= 8
+	}
+	return options
 }
 
 type outstandingMessage struct {
@@ -58,6 +103,48 @@ type outstandingPublishMessage struct {
 	dup     bool
 	qos     uint8
 	retain  bool
+
+	// The shared subscription the message was delivered through, empty for
+	// ordinary subscriptions.
+	sharedFilter TopicFilter
+
+	// When the message expires, zero if it never does.
+	expiresAt time.Time
+
+	// MQTT 5 properties that are forwarded to subscribers, nil if there are
+	// none. See forwardedProperties.
+	properties *messages.Properties
+}
+
+// forwardedProperties returns the properties of a PUBLISH message that the
+// server passes on to subscribers unaltered [MQTT5-3.3.2-4],
+// [MQTT5-3.3.2-15], [MQTT5-3.3.2-16], [MQTT5-3.3.2-17], [MQTT5-3.3.2-20].
+// Returns nil if props has none of them.
+func forwardedProperties(props *messages.Properties) *messages.Properties {
+	if props == nil || (props.PayloadFormatIndicator == 0 && props.ContentType == "" && props.ResponseTopic == "" &&
+		props.CorrelationData == nil && len(props.UserProperties) == 0) {
+		return nil
+	}
+	return &messages.Properties{
+		PayloadFormatIndicator: props.PayloadFormatIndicator,
+		ContentType:            props.ContentType,
+		ResponseTopic:          props.ResponseTopic,
+		CorrelationData:        props.CorrelationData,
+		UserProperties:         props.UserProperties,
+	}
+}
+
+// decodeStoredProperties decodes the properties of a message kept in a store.
+func decodeStoredProperties(b []byte) *messages.Properties {
+	if len(b) == 0 {
+		return nil
+	}
+	props, err := messages.DecodeProperties(b)
+	if err != messages.ErrNone {
+		logger.Warningf("Can't decode stored message properties, dropping them")
+		return nil
+	}
+	return props
 }
 
 type outstandingPubRelMessage struct {
@@ -68,7 +155,9 @@ type outstandingPubRecMessage struct {
 	outstandingMessage
 }
 
-func (dm *outstandingPublishMessage) toMessage() *messages.Message {
+// toMessage encodes the message for a client using protocolLevel. If aliases
+// is not nil, the topic is replaced by a topic alias.
+func (dm *outstandingPublishMessage) toMessage(protocolLevel byte, aliases *topicAliases) *messages.Message {
 	var dupFlag uint8 = 0
 	if dm.dup {
 		dupFlag = 1
@@ -77,58 +166,185 @@ func (dm *outstandingPublishMessage) toMessage() *messages.Message {
 	if dm.retain {
 		retainFlag = 1
 	}
-	msg := &messages.Message{messages.Publish, dupFlag<<3 | dm.qos<<1 | retainFlag, []byte{}}
+	topic := dm.topic
+	props := &messages.Properties{}
+	if fwd := dm.properties; fwd != nil {
+		*props = *fwd
+	}
+	if aliases != nil && protocolLevel == protocolLevel5 {
+		alias, known := aliases.get(topic)
+		props.TopicAlias = alias
+		if known {
+			topic = ""
+		}
+	}
+	msg := &messages.Message{Type: messages.Publish, Flags: dupFlag<<3 | dm.qos<<1 | retainFlag, Data: []byte{}}
 	pw := msg.PayloadWriter()
-	pw.WriteString(string(dm.topic))
+	pw.WriteString(string(topic))
 	if dm.qos > 0 {
 		pw.WriteUint16(dm.packetId)
 	}
+	if protocolLevel == protocolLevel5 {
+		if !dm.expiresAt.IsZero() {
+			// [MQTT5-3.3.2-6]: Send the remaining lifetime.
+			props.MessageExpiryInterval = messages.Uint32(dm.remainingLifetime())
+		}
+		pw.WriteProperties(props)
+	}
 	pw.WriteBytes(dm.payload)
 	return msg
 }
 
+func (dm *outstandingPublishMessage) toStoredMessage() *StoredMessage {
+	return &StoredMessage{
+		PacketId:     dm.packetId,
+		Topic:        dm.topic,
+		Payload:      dm.payload,
+		QoS:          dm.qos,
+		Retain:       dm.retain,
+		ExpiresAt:    unixTime(dm.expiresAt),
+		Properties:   dm.properties.Encode(),
+		SharedFilter: dm.sharedFilter,
+	}
+}
+
+func newOutstandingPublishMessageFromStore(msg *StoredMessage) *outstandingPublishMessage {
+	return &outstandingPublishMessage{
+		outstandingMessage: outstandingMessage{
+			packetId: msg.PacketId,
+		},
+		topic:        msg.Topic,
+		payload:      msg.Payload,
+		qos:          msg.QoS,
+		retain:       msg.Retain,
+		expiresAt:    fromUnixTime(msg.ExpiresAt),
+		properties:   decodeStoredProperties(msg.Properties),
+		sharedFilter: msg.SharedFilter,
+	}
+}
+
 func (dm *outstandingPubRelMessage) toMessage() *messages.Message {
-	msg := &messages.Message{messages.PubRel, 2, []byte{}}
+	msg := &messages.Message{Type: messages.PubRel, Flags: 2, Data: []byte{}}
 	pw := msg.PayloadWriter()
 	pw.WriteUint16(dm.packetId)
 	return msg
 }
 
 func (dm *outstandingPubRecMessage) toMessage() *messages.Message {
-	msg := &messages.Message{messages.PubRec, 0, []byte{}}
+	msg := &messages.Message{Type: messages.PubRec, Flags: 0, Data: []byte{}}
 	pw := msg.PayloadWriter()
 	pw.WriteUint16(dm.packetId)
 	return msg
 }
 
 type will struct {
-	retain bool
-	qos    uint8
-	topic  TopicName
-	data   []byte
+	retain     bool
+	qos        uint8
+	topic      TopicName
+	data       []byte
+	properties *messages.Properties // MQTT 5 only
+}
+
+// sessionState is the part of a session that is not tied to a network
+// connection. For clients connecting with cleanSession == 0, it is kept
+// by the server and handed to the next connection with the same client id.
+type sessionState struct {
+	clientId      string
+	nextPacketId  uint16
+	lock          sync.Mutex
+	subscriptions map[TopicFilter]*Subscription
+
+	unacknowledgedPublishes map[uint16]*outstandingPublishMessage
+	unacknowledgedPubRels   map[uint16]*outstandingPubRelMessage
+	unacknowledgedPubRecs   map[uint16]*outstandingPubRecMessage
+
+	// Session currently using this state, nil if the client is offline.
+	session *Session
+	// QoS 1 and 2 messages received while the client was offline, or while
+	// its receive maximum was reached.
+	queuedMessages []*outstandingPublishMessage
+
+	// Where the state is persisted. nil if the session is not persistent.
+	store Store
+
+	// Session expiry interval in seconds, sessionNeverExpires if the state
+	// is kept forever [MQTT5-3.1.2-23].
+	expiryInterval uint32
+	// When the state of an offline session is discarded. Zero while the
+	// client is connected, and for sessions that never expire.
+	expiresAt time.Time
+	// Will of the last connection waiting for its delay interval to pass,
+	// nil if there is none.
+	delayedWill *delayedWill
+}
+
+// persist calls f with the session's store if the session is persistent.
+func (s *sessionState) persist(f func(store Store) error) {
+	if s.store == nil {
+		return
+	}
+	if err := f(s.store); err != nil {
+		logger.Warningf("Client %s: Can't update session store: %s", s.clientId, err)
+	}
+}
+
+func newSessionState() *sessionState {
+	return &sessionState{
+		nextPacketId:            1,
+		subscriptions:           make(map[TopicFilter]*Subscription),
+		unacknowledgedPublishes: make(map[uint16]*outstandingPublishMessage),
+		unacknowledgedPubRels:   make(map[uint16]*outstandingPubRelMessage),
+		unacknowledgedPubRecs:   make(map[uint16]*outstandingPubRecMessage),
+	}
 }
 
 type Session struct {
+	*sessionState
+
 	id                uint32
 	conn              net.Conn
+	closeOnce         sync.Once
+	done              chan struct{} // closed when the session has terminated
 	createdAt         time.Time
 	connected         bool
+	cleanSession      bool
+	protocolLevel     byte
+	listener          *listener // the listener that accepted the connection
+	clientInfo        *ClientInfo
+	certIdentity      string // identity from the client's TLS certificate
+	peerCredentials   *PeerCredentials
 	keepAliveDuration time.Duration
-	nextPacketId      uint16
-	lock              sync.Mutex
-	subscriptions     map[TopicFilter]*Subscription
+
+	// Topic aliases are only valid for the current connection
+	// [MQTT5-3.3.2-7]. outboundAliases is nil if the client does not accept
+	// topic aliases.
+	inboundAliases  map[uint16]TopicName
+	outboundAliases *topicAliases
+
+	// Maximum number of unacknowledged QoS 1 and 2 messages the client
+	// accepts. 0 means no limit.
+	receiveMaximum int
+	// Size of the largest packet the client accepts. 0 means no limit.
+	maxPacketSize uint32
+
+	// Enhanced authentication method agreed on in CONNECT, empty if none.
+	authMethod string
+	// Re-authentication in progress, nil if there is none. authInfo
+	// receives the user name the client re-authenticates as.
+	authExchange AuthExchange
+	authInfo     *ClientInfo
 
 	will *will
 
 	lastMessageReceived time.Time
 
-	unacknowledgedPublishes map[uint16]*outstandingPublishMessage
-	unacknowledgedPubRels   map[uint16]*outstandingPubRelMessage
-	unacknowledgedPubRecs   map[uint16]*outstandingPubRecMessage
-
 	server *Server
 }
 
+func (s *Session) isV5() bool {
+	return s.protocolLevel == protocolLevel5
+}
+
 func (s *Session) deadlineExceeded() bool {
 	deadline := s.lastMessageReceived.Add(s.keepAliveDuration)
 	return time.Now().After(deadline)
@@ -136,9 +352,6 @@ func (s *Session) deadlineExceeded() bool {
 
 func (s *Session) newOutstandingPublishMessage(topicName TopicName, data []byte, retain bool, qos uint8) *outstandingPublishMessage {
 	om := &outstandingPublishMessage{
-		outstandingMessage: outstandingMessage{
-			packetId: s.GetNextPacketId(),
-		},
 		topic:   topicName,
 		payload: data,
 		dup:     false,
@@ -148,30 +361,126 @@ func (s *Session) newOutstandingPublishMessage(topicName TopicName, data []byte,
 	return om
 }
 
+// sendPublish sends msg to the client. QoS 1 and 2 messages are queued
+// instead if the client's receive maximum is reached.
 func (s *Session) sendPublish(msg *outstandingPublishMessage) {
-	logger.Infof("Session %d: --> PUBLISH %#v", s.id, msg)
+	if s.tooLarge(msg) {
+		logger.Infof("Session %d: PUBLISH for %s exceeds the client's maximum packet size, dropping it", s.id, msg.topic)
+		return
+	}
 	if msg.qos > 0 {
-		msg.nextSendTime = time.Now().Add(10 * time.Second)
-		msg.sendCount = 1
 		s.lock.Lock()
-		s.unacknowledgedPublishes[msg.packetId] = msg
+		if len(s.queuedMessages) > 0 || s.inflightFull() {
+			if s.server.queueFull(s.sessionState) {
+				switch s.server.config.QueueOverflowPolicy {
+				case DropOldest:
+					s.dropOldestQueued()
+				case DropNewest:
+					logger.Infof("Session %d: Queue is full, dropping message", s.id)
+					s.lock.Unlock()
+					return
+				case Disconnect:
+					// The client can't keep up; like an offline session,
+					// its session is discarded.
+					logger.Infof("Session %d: Queue is full, discarding session", s.id)
+					s.lock.Unlock()
+					s.setExpiryInterval(0)
+					s.disconnect(ReasonQuotaExceeded, "Message queue is full")
+					return
+				}
+			}
+			logger.Infof("Session %d: Receive maximum reached, queueing PUBLISH", s.id)
+			s.queuedMessages = append(s.queuedMessages, msg)
+			s.persist(func(store Store) error { return store.Enqueue(s.clientId, msg.toStoredMessage()) })
+			s.lock.Unlock()
+			s.sendQueued()
+			return
+		}
+		s.addInflight(msg)
 		s.lock.Unlock()
 	}
-	msg.toMessage().Send(s.conn)
+	logger.Infof("Session %d: --> PUBLISH %#v", s.id, msg)
+	s.writePublish(msg)
 	logger.Infof("Session %d: --> PUBLISH DONE %#v", s.id, msg)
 }
 
-func (s *Session) sendSubAck(packetId uint16, maxQoS int) {
-	logger.Infof("Session %d: --> SUBACK(%d)", s.id, packetId)
-	msg := &messages.Message{messages.SubAck, 0, []byte{}}
+// writePublish encodes msg for the client and sends it.
+func (s *Session) writePublish(msg *outstandingPublishMessage) {
+	if s.outboundAliases == nil {
+		msg.toMessage(s.protocolLevel, nil).Send(s.conn)
+		return
+	}
+	s.outboundAliases.lock.Lock()
+	defer s.outboundAliases.lock.Unlock()
+	msg.toMessage(s.protocolLevel, s.outboundAliases).Send(s.conn)
+}
+
+// tooLarge returns whether msg might exceed the client's maximum packet
+// size. Such messages are discarded as if they had been delivered
+// [MQTT5-3.1.2-25].
+func (s *Session) tooLarge(msg *outstandingPublishMessage) bool {
+	if s.maxPacketSize == 0 {
+		return false
+	}
+	size := msg.toMessage(s.protocolLevel, nil).Size()
+	if s.outboundAliases != nil {
+		// A topic alias property, which might also make the length
+		// fields longer.
+		size += 5
+	}
+	return size > int(s.maxPacketSize)
+}
+
+// SUBACK return code for a refused subscription
+const subAckFailure byte = 0x80
+
+// sendSubAck sends a SUBACK with the given MQTT 5 reason codes. MQTT 3.1.1
+// clients only learn that a subscription failed.
+func (s *Session) sendSubAck(packetId uint16, reasonCodes []byte) {
+	logger.Infof("Session %d: --> SUBACK(%d) %v", s.id, packetId, reasonCodes)
+	msg := &messages.Message{Type: messages.SubAck, Flags: 0, Data: []byte{}}
 	pw := msg.PayloadWriter()
 	pw.WriteUint16(packetId)
-	pw.WriteUint8(uint8(maxQoS))
+	if s.isV5() {
+		pw.WriteProperties(nil)
+	}
+	for _, reasonCode := range reasonCodes {
+		if reasonCode >= ReasonUnspecifiedError && !s.isV5() {
+			reasonCode = subAckFailure
+		}
+		pw.WriteUint8(reasonCode)
+	}
 	msg.Send(s.conn)
 }
 
-func (s *Session) sendPubRec(packetId uint16) {
-	logger.Infof("Session %d: --> PUBREC(%d)", s.id, packetId)
+// newAck creates a PUBACK, PUBREC, PUBREL, or PUBCOMP message. The reason
+// code is only sent to MQTT 5 clients, and only if it is not ReasonSuccess.
+func (s *Session) newAck(t messages.MessageType, packetId uint16, reasonCode byte) *messages.Message {
+	var flags uint8 = 0
+	if t == messages.PubRel {
+		flags = 2
+	}
+	msg := &messages.Message{Type: t, Flags: flags, Data: []byte{}}
+	pw := msg.PayloadWriter()
+	pw.WriteUint16(packetId)
+	if s.isV5() && reasonCode != ReasonSuccess {
+		pw.WriteUint8(reasonCode)
+	}
+	return msg
+}
+
+func (s *Session) sendPubAck(packetId uint16, reasonCode byte) {
+	logger.Infof("Session %d: --> PUBACK(%d) 0x%02x", s.id, packetId, reasonCode)
+	s.newAck(messages.PubAck, packetId, reasonCode).Send(s.conn)
+}
+
+func (s *Session) sendPubRec(packetId uint16, reasonCode byte) {
+	logger.Infof("Session %d: --> PUBREC(%d) 0x%02x", s.id, packetId, reasonCode)
+	if reasonCode >= ReasonUnspecifiedError {
+		// The flow ends here, the client won't send a PUBREL.
+		s.newAck(messages.PubRec, packetId, reasonCode).Send(s.conn)
+		return
+	}
 	m := &outstandingPubRecMessage{
 		outstandingMessage: outstandingMessage{
 			packetId:     packetId,
@@ -182,7 +491,8 @@ func (s *Session) sendPubRec(packetId uint16) {
 	s.lock.Lock()
 	s.unacknowledgedPubRecs[packetId] = m
 	s.lock.Unlock()
-	m.toMessage().Send(s.conn)
+	s.persist(func(store Store) error { return store.StorePubRec(s.clientId, packetId) })
+	s.newAck(messages.PubRec, packetId, reasonCode).Send(s.conn)
 }
 
 func (s *Session) sendPubRel(packetId uint16) {
@@ -197,106 +507,323 @@ func (s *Session) sendPubRel(packetId uint16) {
 	s.lock.Lock()
 	s.unacknowledgedPubRels[packetId] = m
 	s.lock.Unlock()
+	s.persist(func(store Store) error { return store.StorePubRel(s.clientId, packetId) })
 	m.toMessage().Send(s.conn)
 }
 
-func (s *Session) sendPubComp(packetId uint16) {
-	logger.Infof("Session %d: --> PUBCOMP(%d)", s.id, packetId)
-	m := &messages.Message{messages.PubComp, 0, []byte{}}
-	pw := m.PayloadWriter()
-	pw.WriteUint16(packetId)
-	m.Send(s.conn)
+func (s *Session) sendPubComp(packetId uint16, reasonCode byte) {
+	logger.Infof("Session %d: --> PUBCOMP(%d) 0x%02x", s.id, packetId, reasonCode)
+	s.newAck(messages.PubComp, packetId, reasonCode).Send(s.conn)
 }
 
-func (s *Session) AddSubscription(filter TopicFilter, qos uint8) {
-	sub := &Subscription{qos, filter}
+func (s *Session) AddSubscription(sub *Subscription) {
+	s.lock.Lock()
+	s.subscriptions[sub.filter] = sub
+	s.lock.Unlock()
+	s.persist(func(store Store) error { return store.AddSubscription(s.clientId, sub.filter, sub.options()) })
 	logger.Infof("Session %d: New Subscription %+v", s.id, sub)
+}
 
-	// [MQTT-3.3.1-6].
-	logger.Infof("Session %d: Matching topics:", s.id)
-	matchingTopics := topics.filter(filter)
-	for _, topic := range matchingTopics {
-		logger.Infof("  %s", topic.name)
-		if topic.retainedMessage != nil {
-			copy := *topic.retainedMessage
-			if copy.qos < qos {
-				copy.qos = qos
-			}
-			copy.retain = true // [MQTT-3.3.1-8]
-			s.sendPublish(&copy)
+// hasSubscription returns whether there is a subscription for filter.
+func (s *sessionState) hasSubscription(filter TopicFilter) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, found := s.subscriptions[filter]
+	return found
+}
+
+// sendRetainedMessages sends the retained messages of all topics matching a
+// new subscription [MQTT-3.3.1-6].
+func (s *Session) sendRetainedMessages(filter TopicFilter, qos uint8) {
+	logger.Infof("Session %d: Matching retained messages:", s.id)
+	for _, retained := range s.server.retainedMessages(filter) {
+		logger.Infof("  %s", retained.topic)
+		copy := *retained
+		if copy.qos > qos {
+			copy.qos = qos
 		}
+		copy.retain = true // [MQTT-3.3.1-8]
+		s.sendPublish(&copy)
 	}
-	s.subscriptions[filter] = sub
 }
 
-func (s *Session) RemoveSubscription(filter TopicFilter) {
+// RemoveSubscription removes the subscription for filter. Returns false if
+// there was no such subscription.
+func (s *Session) RemoveSubscription(filter TopicFilter) bool {
+	s.lock.Lock()
+	_, found := s.subscriptions[filter]
 	delete(s.subscriptions, filter)
+	s.lock.Unlock()
+	if found {
+		s.persist(func(store Store) error { return store.RemoveSubscription(s.clientId, filter) })
+	}
+	return found
 }
 
-func (s *Session) findSubscriptions(name TopicName) []*Subscription {
-	var res []*Subscription
+// findSubscriptions returns the ordinary and the shared subscriptions
+// matching name.
+func (s *sessionState) findSubscriptions(name TopicName) (subs []*Subscription, shared []*Subscription) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	for _, sub := range s.subscriptions {
-		if sub.filter.matches(name) {
-			res = append(res, sub)
+		if _, filter, ok := sub.filter.shared(); ok {
+			if filter.matches(name) {
+				shared = append(shared, sub)
+			}
+		} else if sub.filter.matches(name) {
+			subs = append(subs, sub)
 		}
 	}
-	return res
+	return subs, shared
 }
 
 func (s *Session) Close() {
-	logger.Infof("Session %d: Closing session", s.id)
-
-	if s.will != nil {
-		om := s.newOutstandingPublishMessage(s.will.topic, s.will.data, s.will.retain, s.will.qos)
-		s.sendToSubscribers(om)
-	}
+	s.closeOnce.Do(func() {
+		logger.Infof("Session %d: Closing session", s.id)
+
+		if s.will != nil {
+			if delay := s.willDelay(); delay > 0 {
+				s.delayWill(s.will, delay)
+			} else {
+				s.publishWill(s.will)
+			}
+		}
 
-	s.conn.Close()
+		s.conn.Close()
+	})
 }
 
 func (s *Session) GetNextPacketId() uint16 {
 	s.lock.Lock()
-	res := s.nextPacketId
-	s.nextPacketId++
-	s.lock.Unlock()
-	return res
+	defer s.lock.Unlock()
+	return s.nextFreePacketId()
+}
+
+// nextFreePacketId returns a packet id that is not in use. Must be called
+// with s.lock held.
+func (s *sessionState) nextFreePacketId() uint16 {
+	for {
+		res := s.nextPacketId
+		s.nextPacketId++
+		if s.nextPacketId == 0 { // [MQTT-2.3.1-1]
+			s.nextPacketId = 1
+		}
+		_, publishInUse := s.unacknowledgedPublishes[res]
+		_, pubRelInUse := s.unacknowledgedPubRels[res]
+		if !publishInUse && !pubRelInUse {
+			return res
+		}
+	}
+}
+
+// resendUnacknowledged re-sends all PUBLISH and PUBREL messages of a resumed
+// session that have not been acknowledged yet [MQTT-4.4.0-1].
+func (s *Session) resendUnacknowledged() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	s.dropExpiredPublishes(now)
+	for packetId, msg := range s.unacknowledgedPublishes {
+		if s.tooLarge(msg) {
+			// The client reconnected with a smaller maximum packet size.
+			logger.Infof("Session %d: PUBLISH(%d) exceeds the client's maximum packet size, dropping it", s.id, packetId)
+			delete(s.unacknowledgedPublishes, packetId)
+			s.persist(func(store Store) error { return store.DeletePublish(s.clientId, packetId) })
+			continue
+		}
+		logger.Infof("Session %d: Resending PUBLISH(%d)", s.id, msg.packetId)
+		msg.nextSendTime = now
+		msg.computeNextSendTime()
+		msg.dup = true
+		s.writePublish(msg)
+	}
+	for _, msg := range s.unacknowledgedPubRels {
+		logger.Infof("Session %d: Resending PUBREL(%d)", s.id, msg.packetId)
+		msg.nextSendTime = now
+		msg.computeNextSendTime()
+		msg.toMessage().Send(s.conn)
+	}
 }
 
-func (s *Session) sendConnAck(res byte, sessionPresent bool) {
-	logger.Infof("Session %d: --> CONACK", s.id)
+// sendConnAck sends a CONNACK with an MQTT 5 reason code, which is mapped
+// to the corresponding return code for older clients. props are only sent
+// to MQTT 5 clients.
+func (s *Session) sendConnAck(reasonCode byte, sessionPresent bool, props *messages.Properties) {
+	logger.Infof("Session %d: --> CONACK 0x%02x", s.id, reasonCode)
 	b0 := byte(0)
 	if sessionPresent {
 		b0 = 1
 	}
-	msg := messages.Message{messages.ConnAck, 0, []byte{b0, res}}
+	msg := &messages.Message{Type: messages.ConnAck, Flags: 0, Data: []byte{b0}}
+	pw := msg.PayloadWriter()
+	if s.isV5() {
+		pw.WriteUint8(reasonCode)
+		pw.WriteProperties(props)
+	} else {
+		pw.WriteUint8(connAckReturnCode(reasonCode))
+	}
 	msg.Send(s.conn)
 }
 
+// disconnect closes the connection because of a protocol violation or on
+// the server's initiative. MQTT 5 clients are sent a DISCONNECT with the
+// reason code and the human readable reason first.
+func (s *Session) disconnect(reasonCode byte, reason string) {
+	s.disconnectWithProperties(reasonCode, &messages.Properties{ReasonString: reason})
+}
+
+// disconnectWithProperties is like disconnect, but sends props with the
+// DISCONNECT, e.g. a server reference.
+func (s *Session) disconnectWithProperties(reasonCode byte, props *messages.Properties) {
+	if s.isV5() {
+		logger.Infof("Session %d: --> DISCONNECT 0x%02x %q", s.id, reasonCode, props.ReasonString)
+		msg := newDisconnect(reasonCode, props)
+		if s.maxPacketSize > 0 && uint32(msg.Size()) > s.maxPacketSize { // [MQTT5-3.14.2-3]
+			stripped := *props
+			stripped.ReasonString = ""
+			stripped.UserProperties = nil
+			msg = newDisconnect(reasonCode, &stripped)
+		}
+		msg.Send(s.conn)
+	}
+	s.Close()
+}
+
+func newDisconnect(reasonCode byte, props *messages.Properties) *messages.Message {
+	msg := &messages.Message{Type: messages.Disconnect, Flags: 0, Data: []byte{reasonCode}}
+	msg.PayloadWriter().WriteProperties(props)
+	return msg
+}
+
 func (s *Session) sendPingResp() {
 	logger.Infof("Session %d: --> PINGRESP", s.id)
-	msg := &messages.Message{messages.PingResp, 0, []byte{}}
+	msg := &messages.Message{Type: messages.PingResp, Flags: 0, Data: []byte{}}
 	msg.Send(s.conn)
 }
 
-func (s *Session) sendToSubscribers(om *outstandingPublishMessage) {
-	// Publish to subscribed sessions
-	for _, sess := range s.server.sessions {
-		logger.Infof("Session %d: checking Session %d", s.id, sess.id)
-		if sess == s {
+// goOnline attaches the session to its state and sends the messages that
+// were queued while the client was offline, as far as the client's receive
+// maximum permits.
+func (s *Session) goOnline() {
+	s.lock.Lock()
+	s.sessionState.session = s
+	queued := len(s.queuedMessages)
+	s.lock.Unlock()
+	if queued > 0 {
+		logger.Infof("Session %d: %d queued messages", s.id, queued)
+	}
+	s.sendQueued()
+}
+
+// sendToSubscribers publishes om to all subscribed sessions, and queues it
+// for offline persistent sessions. Every shared subscription group gets one
+// copy. Returns the number of subscribed sessions and groups.
+func (s *Session) sendToSubscribers(om *outstandingPublishMessage) int {
+	subscribers := 0
+	groups := make(map[TopicFilter][]shareMember)
+	for _, state := range s.server.sessionStates() {
+		subs, shared := state.findSubscriptions(om.topic)
+		for _, sub := range shared {
+			groups[sub.filter] = append(groups[sub.filter], shareMember{state, sub})
+		}
+		sub := s.mergeSubscriptions(state, subs)
+		if sub == nil {
+			logger.Infof("Session %d: Client %s not subscribed to %s", s.id, state.clientId, om.topic)
 			continue
 		}
-		if subs := sess.findSubscriptions(om.topic); len(subs) > 0 {
-			logger.Infof("Session %d: publish message to Session %d", s.id, sess.id)
-			omCopy := *om
-			omCopy.retain = false // [MQTT-3.3.1-9]
-			if subs[0].qos < omCopy.qos {
-				omCopy.qos = subs[0].qos
-			}
-			sess.sendPublish(&omCopy)
-		} else {
-			logger.Infof("Session %d: Session %d not subscribed to %s", s.id, sess.id, om.topic)
+		subscribers++
+		s.server.deliver(state, om, sub)
+	}
+	for filter, members := range groups {
+		if s.server.sendToShareGroup(filter, members, om) {
+			subscribers++
 		}
 	}
+	return subscribers
+}
+
+// mergeSubscriptions combines the subscriptions of the client of state that
+// match a message published by s, so the client gets a single copy with the
+// maximum QoS [MQTT5-3.3.4-2]. Subscriptions with No Local set don't match
+// the client's own messages [MQTT5-3.8.3-3]. Returns nil if no subscription
+// applies.
+func (s *Session) mergeSubscriptions(state *sessionState, subs []*Subscription) *Subscription {
+	var res *Subscription
+	for _, sub := range subs {
+		if sub.noLocal && state == s.sessionState {
+			continue
+		}
+		if res == nil {
+			merged := *sub
+			res = &merged
+			continue
+		}
+		if sub.qos > res.qos {
+			res.qos = sub.qos
+		}
+		res.retainAsPublished = res.retainAsPublished || sub.retainAsPublished
+	}
+	return res
+}
+
+// deliver sends om to the client of state according to the subscription's
+// options, or queues it if the client is offline.
+func (s *Server) deliver(state *sessionState, om *outstandingPublishMessage, sub *Subscription) {
+	omCopy := *om
+	// [MQTT-3.3.1-9], [MQTT5-3.3.1-12], [MQTT5-3.3.1-13]
+	omCopy.retain = om.retain && sub.retainAsPublished
+	omCopy.sharedFilter = ""
+	if _, _, shared := sub.filter.shared(); shared {
+		omCopy.sharedFilter = sub.filter
+	}
+	if sub.qos < omCopy.qos {
+		omCopy.qos = sub.qos
+	}
+	sess := s.enqueueIfOffline(state, &omCopy)
+	if sess == nil {
+		logger.Infof("Client %s is offline", state.clientId)
+		return
+	}
+	logger.Infof("Publishing message to session %d", sess.id)
+	sess.sendPublish(&omCopy)
+}
+
+func (s *Session) authenticator() Authenticator {
+	if auth := s.listener.config.Authenticator; auth != nil {
+		return auth
+	}
+	return s.server.config.Authenticator
+}
+
+// authMethods returns the enhanced authentication methods for the session's
+// listener. A listener with its own Authenticator only offers its own
+// methods, so that clients can't bypass it with the server's.
+func (s *Session) authMethods() map[string]AuthMethod {
+	if config := s.listener.config; config.AuthMethods != nil || config.Authenticator != nil {
+		return config.AuthMethods
+	}
+	return s.server.config.AuthMethods
+}
+
+// authorizer returns the Authorizer for the session's listener.
+func (s *Session) authorizer() Authorizer {
+	if authorizer := s.listener.config.Authorizer; authorizer != nil {
+		return authorizer
+	}
+	return s.server.config.Authorizer
+}
+
+func (s *Session) canPublish(info *ClientInfo, topic TopicName) bool {
+	authorizer := s.authorizer()
+	return authorizer == nil || authorizer.CanPublish(info, topic)
+}
+
+func (s *Session) canSubscribe(filter TopicFilter) bool {
+	// ACLs apply to the topic filter of shared subscriptions, regardless
+	// of the group.
+	_, filter, _ = filter.shared()
+	authorizer := s.authorizer()
+	return authorizer == nil || authorizer.CanSubscribe(s.clientInfo, filter)
 }
 
 func (s *Session) handlePublish(msg *messages.Message) {
@@ -309,6 +836,12 @@ func (s *Session) handlePublish(msg *messages.Message) {
 	logger.Infof("  QoS: %d", qos)
 	logger.Infof("  RETAIN: %t", retainFlag)
 
+	if qos == 3 { // [MQTT-3.3.1-4]
+		logger.Warningf("Invalid QoS 3, closing connection")
+		s.disconnect(ReasonMalformedPacket, "Invalid QoS 3")
+		return
+	}
+
 	pr := msg.PayloadReader(0)
 	topicName := TopicName(pr.GetString())
 	logger.Infof("  topicName: %s", topicName)
@@ -317,39 +850,84 @@ func (s *Session) handlePublish(msg *messages.Message) {
 		packetId = pr.GetUint16()
 		logger.Infof("  packetId: %d", packetId)
 	}
+	props := &messages.Properties{}
+	if s.isV5() {
+		var err messages.Error
+		if props, err = pr.GetProperties(); err != messages.ErrNone {
+			logger.Warningf("Invalid properties, closing connection")
+			s.disconnect(reasonCodeForError(err), "Invalid properties")
+			return
+		}
+		if alias := props.TopicAlias; alias != 0 {
+			if alias > s.server.config.TopicAliasMaximum { // [MQTT5-3.3.2-9]
+				logger.Warningf("Topic alias %d exceeds the maximum, closing connection", alias)
+				s.disconnect(ReasonTopicAliasInvalid, fmt.Sprintf("Topic alias %d exceeds the maximum", alias))
+				return
+			}
+			if topicName != "" {
+				if s.inboundAliases == nil {
+					s.inboundAliases = make(map[uint16]TopicName)
+				}
+				s.inboundAliases[alias] = topicName
+			} else if topicName = s.inboundAliases[alias]; topicName == "" {
+				logger.Warningf("Unknown topic alias %d, closing connection", alias)
+				s.disconnect(ReasonProtocolError, fmt.Sprintf("Unknown topic alias %d", alias))
+				return
+			}
+			logger.Infof("  topicAlias: %d -> %s", alias, topicName)
+		} else if topicName == "" {
+			logger.Warningf("Empty topic name without topic alias, closing connection")
+			s.disconnect(ReasonProtocolError, "Empty topic name without topic alias")
+			return
+		}
+		if strings.ContainsAny(props.ResponseTopic, "+#") { // [MQTT5-3.3.2-14]
+			logger.Warningf("Wildcards in response topic %q, closing connection", props.ResponseTopic)
+			s.disconnect(ReasonProtocolError, "Wildcards in response topic")
+			return
+		}
+	}
 	data := msg.Data[pr.GetCurPos():]
 	logger.Infof("  data: %+v", data)
 	logger.Infof("  data (string): %+v", string(data))
 
-	om := s.newOutstandingPublishMessage(topicName, data, retainFlag, qos)
+	if qos == 2 {
+		s.lock.Lock()
+		_, received := s.unacknowledgedPubRecs[packetId]
+		s.lock.Unlock()
+		if received {
+			// [MQTT-4.3.3-2]: Already delivered, just acknowledge again
+			logger.Infof("Session %d: PUBLISH(%d) already received", s.id, packetId)
+			s.sendPubRec(packetId, ReasonSuccess)
+			return
+		}
+	}
 
-	// Store retained message if necessary
-	if retainFlag { // [MQTT-3.3.1-5]
-		tops := topics.filter(TopicFilter(topicName))
-		if len(tops) == 0 {
-			tops = []*Topic{&Topic{topicName, om}}
-			topics = append(topics, tops...)
+	om := s.newOutstandingPublishMessage(topicName, data, retainFlag, qos)
+	om.expiresAt = s.messageExpiry(props)
+	om.properties = forwardedProperties(props)
+
+	reasonCode := ReasonSuccess
+	if s.canPublish(s.clientInfo, topicName) {
+		// Store retained message if necessary
+		if retainFlag { // [MQTT-3.3.1-5]
+			s.server.retain(om)
 		}
-		if len(msg.Data) == 0 {
-			tops[0].retainedMessage = nil
-		} else {
-			tops[0].retainedMessage = om
+
+		// Publish to subscribed sessions
+		if s.sendToSubscribers(om) == 0 {
+			reasonCode = ReasonNoMatchingSubscribers
 		}
+	} else {
+		logger.Infof("Session %d: Not authorized to publish to %s, dropping message", s.id, topicName)
+		reasonCode = ReasonNotAuthorized
 	}
 
-	// Publish to subscribed sessions
-	s.sendToSubscribers(om)
-
 	switch qos {
 	case 0: // Do nothing
 	case 1: // Send PUBACK
-		msg = &messages.Message{messages.PubAck, 0, []byte{}}
-		pw := msg.PayloadWriter()
-		pw.WriteUint16(packetId)
-		logger.Infof("Sending PUBACK for Packet ID %d", packetId)
-		msg.Send(s.conn)
+		s.sendPubAck(packetId, reasonCode)
 	case 2: // Send PUBREC
-		s.sendPubRec(packetId)
+		s.sendPubRec(packetId, reasonCode)
 	}
 }
 
@@ -358,23 +936,31 @@ func (s *Session) handlePubAck(msg *messages.Message) {
 	packetId := pr.GetUint16()
 	logger.Infof("Session %d: <-- PUBACK(%d)", s.id, packetId)
 	s.lock.Lock()
-	defer s.lock.Unlock()
 	m, ok := s.unacknowledgedPublishes[packetId]
 	if !ok {
+		s.lock.Unlock()
 		logger.Infof("Session %d: No outstanding PUBLISH for Packet Id %d, ignoring PUBACK", s.id, packetId)
 		return
 	}
 	if m.qos != 1 {
+		s.lock.Unlock()
 		logger.Infof("Session %d: PUBLISH(%d) has qos %d, ignoring PUBACK", s.id, packetId, m.qos)
 		return
 	}
 	delete(s.unacknowledgedPublishes, packetId)
+	s.persist(func(store Store) error { return store.DeletePublish(s.clientId, packetId) })
+	s.lock.Unlock()
+	s.sendQueued()
 }
 
 func (s *Session) handlePubRec(msg *messages.Message) {
 	pr := msg.PayloadReader(0)
 	packetId := pr.GetUint16()
-	logger.Infof("Session %d: <-- PUBREC(%d)", s.id, packetId)
+	reasonCode := ReasonSuccess
+	if s.isV5() && !pr.AtEnd() {
+		reasonCode = pr.GetUint8()
+	}
+	logger.Infof("Session %d: <-- PUBREC(%d) 0x%02x", s.id, packetId, reasonCode)
 	s.lock.Lock()
 	_, ok := s.unacknowledgedPublishes[packetId]
 	delete(s.unacknowledgedPublishes, packetId)
@@ -383,9 +969,17 @@ func (s *Session) handlePubRec(msg *messages.Message) {
 		logger.Infof("Session %d: No outstanding PUBLISH for Packet Id %d, ignoring PUBREC", s.id, packetId)
 		return
 	}
+	if reasonCode >= ReasonUnspecifiedError {
+		// The client refused the message, no PUBREL must follow
+		logger.Infof("Session %d: PUBLISH(%d) refused by client", s.id, packetId)
+		s.persist(func(store Store) error { return store.DeletePublish(s.clientId, packetId) })
+		s.sendQueued()
+		return
+	}
 
 	// send PUBREL
 	s.sendPubRel(packetId)
+	s.persist(func(store Store) error { return store.DeletePublish(s.clientId, packetId) })
 }
 
 func (s *Session) handlePubRel(msg *messages.Message) {
@@ -398,11 +992,15 @@ func (s *Session) handlePubRel(msg *messages.Message) {
 	s.lock.Unlock()
 	if !ok {
 		logger.Infof("Session %d: No outstanding PUBREC for Packet Id %d, ignoring PUBREL", s.id, packetId)
+		if s.isV5() {
+			s.sendPubComp(packetId, ReasonPacketIdentifierNotFound)
+		}
 		return
 	}
+	s.persist(func(store Store) error { return store.DeletePubRec(s.clientId, packetId) })
 
 	// send PUBCOMP
-	s.sendPubComp(packetId)
+	s.sendPubComp(packetId, ReasonSuccess)
 }
 
 func (s *Session) handlePubComp(msg *messages.Message) {
@@ -410,13 +1008,16 @@ func (s *Session) handlePubComp(msg *messages.Message) {
 	packetId := pr.GetUint16()
 	logger.Infof("Session %d: <-- PUBCOMP(%d)", s.id, packetId)
 	s.lock.Lock()
-	defer s.lock.Unlock()
 	_, ok := s.unacknowledgedPubRels[packetId]
 	if !ok {
+		s.lock.Unlock()
 		logger.Infof("Session %d: No outstanding PUBREL for Packet Id %d, ignoring PUBCOMP", s.id, packetId)
 		return
 	}
 	delete(s.unacknowledgedPubRels, packetId)
+	s.persist(func(store Store) error { return store.DeletePubRel(s.clientId, packetId) })
+	s.lock.Unlock()
+	s.sendQueued()
 }
 
 func (s *Session) handlePing(msg *messages.Message) {
@@ -428,113 +1029,167 @@ func (s *Session) handleSubscribe(msg *messages.Message) {
 	logger.Infof("Session %d: <-- SUBSCRIBE", s.id)
 	if msg.Flags != 2 { // [MQTT-3.8.1-1]
 		logger.Warningf("Invalid flags %d, closing connection", msg.Flags)
-		s.Close()
+		s.disconnect(ReasonMalformedPacket, "Invalid flags in SUBSCRIBE")
 		return
 	}
 	pr := msg.PayloadReader(0)
 	packetId := pr.GetUint16()
-	maxQos := -1
+	if s.isV5() {
+		props, err := pr.GetProperties()
+		if err != messages.ErrNone {
+			logger.Warningf("Invalid properties, closing connection")
+			s.disconnect(reasonCodeForError(err), "Invalid properties")
+			return
+		}
+		if len(props.SubscriptionIdentifiers) > 0 { // [MQTT5-3.8.2-1]
+			logger.Warningf("Subscription identifiers are not supported, closing connection")
+			s.disconnect(ReasonSubscriptionIdentifiersNotSupported, "Subscription identifiers are not supported")
+			return
+		}
+	}
+	var requests []*Subscription
 	for !pr.AtEnd() {
 		topicFilter := TopicFilter(pr.GetString())
-		qos := pr.GetUint8()
-		if qos > 2 { // MQTT-3.8.3-4]
-			logger.Warningf("Invalid QoS %d, closing connection", qos)
-			s.Close()
+		options := pr.GetUint8()
+		qos := options & 3
+		// MQTT 3.1.1 has no subscription options [MQTT-3.8.3-4]. In MQTT 5,
+		// the upper two bits are reserved, and Retain Handling must not be 3
+		// [MQTT5-3.8.3-5].
+		if (!s.isV5() && options > 2) || (s.isV5() && (qos > 2 || options&0xc0 != 0 || options&0x30 == 0x30)) {
+			logger.Warningf("Invalid subscription options %d, closing connection", options)
+			s.disconnect(ReasonMalformedPacket, "Invalid subscription options")
 			return
 		}
-		if int(qos) > maxQos {
-			maxQos = int(qos)
+		sub := newSubscription(topicFilter, options)
+		if _, _, shared := topicFilter.shared(); shared && sub.noLocal { // [MQTT5-3.8.3-4]
+			logger.Warningf("No Local set on shared subscription, closing connection")
+			s.disconnect(ReasonProtocolError, "No Local set on shared subscription")
+			return
 		}
-
-		s.AddSubscription(topicFilter, qos)
-
+		requests = append(requests, sub)
 	}
-	if maxQos == -1 { // [MQTT-3.8.3-3]
+	if len(requests) == 0 { // [MQTT-3.8.3-3]
 		logger.Warningf("SUBSCRIBE without topic filters, closing connection")
-		s.Close()
+		s.disconnect(ReasonProtocolError, "SUBSCRIBE without topic filters")
 		return
 	}
 
-	s.sendSubAck(packetId, maxQos)
+	// [MQTT-3.8.4-5]: One return code per topic filter, in the same order.
+	reasonCodes := make([]byte, len(requests))
+	existed := make([]bool, len(requests))
+	for i, req := range requests {
+		existed[i] = s.hasSubscription(req.filter)
+		reasonCodes[i] = s.grantSubscription(req)
+	}
+	s.sendSubAck(packetId, reasonCodes)
+
+	for i, req := range requests {
+		// Retained messages are not sent for shared subscriptions
+		// [MQTT5-4.8.2], and depending on Retain Handling [MQTT5-3.3.1-9],
+		// [MQTT5-3.3.1-10], [MQTT5-3.3.1-11].
+		_, _, shared := req.filter.shared()
+		send := req.retainHandling == retainHandlingSend || (req.retainHandling == retainHandlingSendIfNew && !existed[i])
+		if !shared && send && reasonCodes[i] < ReasonUnspecifiedError {
+			s.sendRetainedMessages(req.filter, reasonCodes[i])
+		}
+	}
+}
+
+// grantSubscription validates and authorizes a single topic filter of a
+// SUBSCRIBE message, and adds the subscription if it is acceptable. Returns
+// the granted QoS, or the reason code why the subscription was refused.
+func (s *Session) grantSubscription(sub *Subscription) byte {
+	filter := sub.filter
+	if !filter.valid() {
+		logger.Infof("Session %d: Invalid topic filter %q", s.id, filter)
+		return ReasonTopicFilterInvalid
+	}
+	if !s.canSubscribe(filter) {
+		logger.Infof("Session %d: Not authorized to subscribe to %s", s.id, filter)
+		return ReasonNotAuthorized
+	}
+	s.AddSubscription(sub)
+	return sub.qos
 }
 
 func (s *Session) handleUnsubscribe(msg *messages.Message) {
 	logger.Infof("Session %d: <-- UNSUBSCRIBE", s.id)
 	if msg.Flags != 2 { // [MQTT-3.10.1-1]
 		logger.Warningf("Invalid flags %d, closing connection", msg.Flags)
-		s.Close()
+		s.disconnect(ReasonMalformedPacket, "Invalid flags in UNSUBSCRIBE")
 		return
 	}
 	pr := msg.PayloadReader(0)
 	packetId := pr.GetUint16()
-	cnt := 0
+	if s.isV5() {
+		if _, err := pr.GetProperties(); err != messages.ErrNone {
+			logger.Warningf("Invalid properties, closing connection")
+			s.disconnect(reasonCodeForError(err), "Invalid properties")
+			return
+		}
+	}
+	var reasonCodes []byte
 	for !pr.AtEnd() {
-		cnt++
 		topicFilter := TopicFilter(pr.GetString())
-		s.RemoveSubscription(topicFilter)
+		if s.RemoveSubscription(topicFilter) {
+			reasonCodes = append(reasonCodes, ReasonSuccess)
+		} else {
+			reasonCodes = append(reasonCodes, ReasonNoSubscriptionExisted)
+		}
 	}
-	if cnt == 0 { // [MQTT-3.10.3-2]
+	if len(reasonCodes) == 0 { // [MQTT-3.10.3-2]
 		logger.Warningf("UNSUBSCRIBE without topic filters, closing connection")
-		s.Close()
+		s.disconnect(ReasonProtocolError, "UNSUBSCRIBE without topic filters")
 		return
 	}
 
-	msg = &messages.Message{messages.UnsubAck, 0, []byte{}}
+	msg = &messages.Message{Type: messages.UnsubAck, Flags: 0, Data: []byte{}}
 	pw := msg.PayloadWriter()
 	pw.WriteUint16(packetId)
+	if s.isV5() {
+		pw.WriteProperties(nil)
+		pw.WriteBytes(reasonCodes)
+	}
 	msg.Send(s.conn)
 }
 
 func (s *Session) handleConnect(msg *messages.Message) {
-	var payloadOfs uint16
-	var flags byte
+	pr := msg.PayloadReader(0)
+	protocolName := pr.GetString()
+	protocolLevel := pr.GetUint8()
+	flags := pr.GetUint8()
+	keepAlive := pr.GetUint16()
 
 	// Check protocol
-	if (msg.Data[0] == 0 && msg.Data[1] == 6 && msg.Data[2] == 'M' && msg.Data[3] == 'Q' && msg.Data[4] == 'I' && msg.Data[5] == 's' && msg.Data[6] == 'd' && msg.Data[7] == 'p') {
+	switch {
+	case protocolName == "MQIsdp" && protocolLevel == protocolLevel31:
 		// MQTT 3.1
-		protocolVersion := msg.Data[8]
-		flags = msg.Data[9]
-		payloadOfs = 12
-
-		if protocolVersion != 3 {
-			logger.Infof("Bad protocol version %d, disconnecting", protocolVersion)
-			s.sendConnAck(0x01 /*unacceptable protocol version*/, false)
-			s.Close()
-			return
-		}
-
-
-	} else if (msg.Data[0] == 0 && msg.Data[1] == 4 && msg.Data[2] == 'M' && msg.Data[3] == 'Q' && msg.Data[4] == 'T' && msg.Data[5] == 'T') {
-		// MQTT 3.1.1
-		protocolVersion := msg.Data[6]
-		flags = msg.Data[7]
-		payloadOfs = 10
-
-		if protocolVersion != 4 {
-			logger.Infof("Bad protocol version %d, disconnecting", protocolVersion)
-			s.sendConnAck(0x01 /*unacceptable protocol version*/, false)
-			s.Close()
-			return
-		}
-
-		if (flags & 1) != 0 {
+	case protocolName == "MQTT" && (protocolLevel == protocolLevel311 || protocolLevel == protocolLevel5):
+		// MQTT 3.1.1 or 5
+		if (flags & 1) != 0 { // [MQTT-3.1.2-3]
 			logger.Infof("Reserved flag is not 0, disconnecting")
 			s.Close()
 			return
 		}
-
-	} else {
+	case protocolName == "MQIsdp" || protocolName == "MQTT":
+		logger.Infof("Bad protocol version %d, disconnecting", protocolLevel)
+		s.sendConnAck(ReasonUnsupportedProtocolVersion, false, nil)
+		s.Close()
+		return
+	default:
 		logger.Info("Unknown protocol, disconnecting")
 		s.Close()
 		return
 	}
+	s.protocolLevel = protocolLevel
+	logger.Infof("  protocolLevel = %d", protocolLevel)
 
 	userNameFlag := (flags & 128) > 0
 	passwordFlag := (flags & 64) > 0
 	willRetain := (flags & 32) > 0
 	willQoS := (flags >> 3) & 3
 	willFlag := (flags & 4) > 0
-	cleanSession := (flags & 2) > 0
+	cleanSession := (flags & 2) > 0 // "Clean Start" in MQTT 5
 
 	logger.Infof("  userNameFlag = %t", userNameFlag)
 	logger.Infof("  passwordFlag = %t", passwordFlag)
@@ -543,39 +1198,178 @@ func (s *Session) handleConnect(msg *messages.Message) {
 	logger.Infof("  willFlag     = %t", willFlag)
 	logger.Infof("  cleanSession = %t", cleanSession)
 
-	s.keepAliveDuration = time.Duration(int64(uint16(msg.Data[8])<<8|uint16(msg.Data[9]))) * time.Second
-	logger.Infof("KeepAliceSecs = %d", s.keepAliveDuration)
+	s.keepAliveDuration = time.Duration(keepAlive) * time.Second
+	logger.Infof("KeepAliveSecs = %d", keepAlive)
+
+	props := &messages.Properties{}
+	if s.isV5() {
+		var err messages.Error
+		if props, err = pr.GetProperties(); err != messages.ErrNone {
+			logger.Infof("Invalid properties, disconnecting")
+			s.sendConnAck(reasonCodeForError(err), false, nil)
+			s.Close()
+			return
+		}
+		if props.AuthenticationData != nil && props.AuthenticationMethod == "" { // [MQTT5-3.1.2.11.10]
+			logger.Infof("Authentication data without authentication method, disconnecting")
+			s.sendConnAck(ReasonProtocolError, false, nil)
+			s.Close()
+			return
+		}
+		if props.AuthenticationMethod != "" && s.authMethods()[props.AuthenticationMethod] == nil {
+			logger.Infof("Unsupported authentication method %q, disconnecting", props.AuthenticationMethod)
+			s.sendConnAck(ReasonBadAuthenticationMethod, false, nil)
+			s.Close()
+			return
+		}
+	}
+	if reasonCode, reference := s.server.draining(); reasonCode != 0 { // [MQTT5-4.11]
+		logger.Infof("Session %d: Server is draining, redirecting client to %q", s.id, reference)
+		s.sendConnAck(reasonCode, false, &messages.Properties{ServerReference: reference})
+		s.Close()
+		return
+	}
+	connAckProps := &messages.Properties{
+		SubscriptionIdentifierAvailable: messages.Bool(false),
+		TopicAliasMaximum:               s.server.config.TopicAliasMaximum,
+		MaximumPacketSize:               s.server.config.MaximumPacketSize,
+	}
+	s.maxPacketSize = props.MaximumPacketSize
+	if props.TopicAliasMaximum > 0 {
+		s.outboundAliases = newTopicAliases(props.TopicAliasMaximum)
+	}
+	s.receiveMaximum = s.server.config.ReceiveMaximum
+	if s.isV5() {
+		s.receiveMaximum = 65535 // [MQTT5-3.1.2.11.3]
+		if props.ReceiveMaximum > 0 {
+			s.receiveMaximum = int(props.ReceiveMaximum)
+		}
+	}
 
-	pr := msg.PayloadReader(payloadOfs)
 	clientId := pr.GetString()
 	logger.Infof("ClientID: %s", clientId)
+	tlsConfig := s.listener.config.TLS
+	if s.certIdentity != "" && tlsConfig.IdentityAsClientId {
+		clientId = s.certIdentity
+		logger.Infof("ClientID from certificate: %s", clientId)
+	}
+	if len(clientId) == 0 {
+		// [MQTT-3.1.3-8], MQTT 3.1 requires a client id
+		if protocolLevel == protocolLevel31 || (protocolLevel == protocolLevel311 && !cleanSession) {
+			logger.Infof("Empty client id, disconnecting")
+			s.sendConnAck(ReasonClientIdentifierNotValid, false, nil)
+			s.Close()
+			return
+		}
+		clientId = fmt.Sprintf("mqttlite-%d-%d", s.id, s.createdAt.UnixNano()) // [MQTT-3.1.3-6]
+		connAckProps.AssignedClientIdentifier = clientId                       // [MQTT5-3.2.2-16]
+		logger.Infof("Assigned ClientID: %s", clientId)
+	}
 
+	var w *will
 	if willFlag {
+		var willProps *messages.Properties
+		if s.isV5() {
+			var err messages.Error
+			if willProps, err = pr.GetProperties(); err != messages.ErrNone {
+				logger.Infof("Invalid will properties, disconnecting")
+				s.sendConnAck(reasonCodeForError(err), false, nil)
+				s.Close()
+				return
+			}
+		}
+
 		willTopic := pr.GetString()
 		logger.Infof("WillTopic: %s", willTopic)
 
 		willMessage := pr.GetBytes()
 		logger.Infof("WillMessage: %v", willMessage)
 
-		s.will = &will{
-			retain: willRetain,
-			qos:    willQoS,
-			topic:  TopicName(willTopic),
-			data:   willMessage,
+		w = &will{
+			retain:     willRetain,
+			qos:        willQoS,
+			topic:      TopicName(willTopic),
+			data:       willMessage,
+			properties: willProps,
 		}
 	}
 
+	info := &ClientInfo{
+		ClientId:        clientId,
+		RemoteAddr:      s.conn.RemoteAddr(),
+		PeerCredentials: s.peerCredentials,
+	}
 	if userNameFlag {
-		userName := pr.GetString()
-		logger.Infof("UserName: %s", userName)
+		info.HasUsername = true
+		info.Username = pr.GetString()
+		logger.Infof("UserName: %s", info.Username)
 	}
 	if passwordFlag {
-		password := pr.GetBytes()
-		logger.Infof("Password: %s", password)
+		if !userNameFlag && protocolLevel == protocolLevel311 { // [MQTT-3.1.2-22]
+			logger.Infof("Password without user name, disconnecting")
+			s.Close()
+			return
+		}
+		info.HasPassword = true
+		info.Password = pr.GetBytes()
+	}
+	if s.certIdentity != "" && tlsConfig.IdentityAsUsername {
+		info.HasUsername = true
+		info.Username = s.certIdentity
+		logger.Infof("UserName from certificate: %s", info.Username)
+	} else if props.AuthenticationMethod != "" {
+		s.authMethod = props.AuthenticationMethod
+		authData, ok := s.authenticateConnect(info, props.AuthenticationData)
+		if !ok {
+			return
+		}
+		connAckProps.AuthenticationMethod = s.authMethod
+		connAckProps.AuthenticationData = authData
+	} else if auth := s.authenticator(); auth != nil {
+		if res := auth.Authenticate(info); res != ConnAccepted {
+			logger.Infof("Session %d: Authentication failed for client %s (user %q), return code %d", s.id, clientId, info.Username, res)
+			s.sendConnAck(connAckReasonCode(res), false, nil)
+			s.Close()
+			return
+		}
 	}
+	if w != nil && !s.canPublish(info, w.topic) {
+		logger.Infof("Session %d: Client %s may not publish its will to %s", s.id, clientId, w.topic)
+		s.sendConnAck(ReasonNotAuthorized, false, nil)
+		s.Close()
+		return
+	}
+	info.Password = nil
+	s.clientInfo = info
+
+	// MQTT 5 sessions outlive the connection if they have a session expiry
+	// interval [MQTT5-3.1.2-23]. Persistent sessions of older clients get
+	// the server's default.
+	var expiryInterval uint32
+	if s.isV5() {
+		if props.SessionExpiryInterval != nil {
+			expiryInterval = *props.SessionExpiryInterval
+		}
+	} else if !cleanSession {
+		expiryInterval = s.server.defaultSessionExpiryInterval()
+	}
+	persistent := expiryInterval > 0
+
+	// Only set the will now: it must not be published if the connection is refused.
+	s.will = w
+	s.cleanSession = !persistent
+	s.server.takeOver(s, clientId)
+	s.server.resolveDelayedWill(clientId, cleanSession)
+	sessionPresent := s.server.attachSessionState(s, clientId, cleanSession, persistent)
+	s.setExpiryInterval(expiryInterval)
+	logger.Infof("Session %d: Session present: %t", s.id, sessionPresent)
 
 	s.connected = true
-	s.sendConnAck(0x00, true)
+	s.sendConnAck(ReasonSuccess, sessionPresent, connAckProps)
+	if sessionPresent {
+		s.resendUnacknowledged()
+	}
+	s.goOnline()
 }
 
 func (s *Session) handleDisconnect(msg *messages.Message) {
@@ -583,21 +1377,98 @@ func (s *Session) handleDisconnect(msg *messages.Message) {
 	// [MQTT-3.14.1-1]: Only clean disconnect if flags == 0
 	if msg.Flags != 0 {
 		logger.Warningf("Invalid flags %d, closing connection", msg.Flags)
-		s.Close()
+		s.disconnect(ReasonMalformedPacket, "Invalid flags in DISCONNECT")
+		return
 	}
 
-	s.will = nil
+	reasonCode := ReasonSuccess
+	if s.isV5() && len(msg.Data) > 0 {
+		pr := msg.PayloadReader(0)
+		reasonCode = pr.GetUint8()
+		if !pr.AtEnd() {
+			props, err := pr.GetProperties()
+			if err != messages.ErrNone {
+				logger.Warningf("Invalid properties, closing connection")
+				s.disconnect(reasonCodeForError(err), "Invalid properties")
+				return
+			}
+			if props.SessionExpiryInterval != nil {
+				s.lock.Lock()
+				current := s.expiryInterval
+				s.lock.Unlock()
+				if current == 0 && *props.SessionExpiryInterval != 0 { // [MQTT5-3.14.2-2]
+					logger.Warningf("Session expiry interval set for a non-persistent session, closing connection")
+					s.disconnect(ReasonProtocolError, "Session expiry interval set for a non-persistent session")
+					return
+				}
+				s.setExpiryInterval(*props.SessionExpiryInterval)
+			}
+		}
+		logger.Infof("Session %d: Reason code 0x%02x", s.id, reasonCode)
+	}
+
+	if reasonCode != ReasonDisconnectWithWill { // [MQTT5-3.14.4-3]
+		s.will = nil
+	}
 	s.Close()
 }
 
+// handleAuth handles re-authentication of a connected client
+// [MQTT5-4.12.1].
+func (s *Session) handleAuth(msg *messages.Message) {
+	if s.authMethod == "" {
+		// No authentication method was agreed on in CONNECT [MQTT5-4.12.0-1]
+		logger.Warningf("Unexpected AUTH, closing connection")
+		s.disconnect(ReasonProtocolError, "No authentication method was agreed on in CONNECT")
+		return
+	}
+	reasonCode, data, refuse := s.readAuth(msg)
+	if refuse != ReasonSuccess {
+		s.disconnect(refuse, "Invalid AUTH")
+		return
+	}
+	switch {
+	case reasonCode == ReasonReAuthenticate && s.authExchange == nil:
+		info := *s.clientInfo
+		s.authInfo = &info
+		s.authExchange = s.authMethods()[s.authMethod].Start(s.authInfo)
+	case reasonCode == ReasonContinueAuthentication && s.authExchange != nil:
+	default:
+		logger.Warningf("Unexpected AUTH reason code 0x%02x, closing connection", reasonCode)
+		s.disconnect(ReasonProtocolError, "Unexpected AUTH reason code")
+		return
+	}
+
+	response, done, err := s.authExchange.Next(data)
+	if err != nil { // [MQTT5-4.12.1-2]
+		logger.Infof("Session %d: Re-authentication failed: %s", s.id, err)
+		s.disconnect(ReasonNotAuthorized, "Re-authentication failed")
+		return
+	}
+	if !done {
+		s.sendAuth(ReasonContinueAuthentication, response)
+		return
+	}
+	s.authExchange = nil
+	if s.authInfo.Username != s.clientInfo.Username {
+		logger.Infof("Session %d: Client re-authenticated as %q instead of %q", s.id, s.authInfo.Username, s.clientInfo.Username)
+		s.disconnect(ReasonNotAuthorized, "Re-authenticated as a different user")
+		return
+	}
+	s.sendAuth(ReasonSuccess, response)
+}
+
 func (s *Session) checkResend() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	now := time.Now()
+	s.dropExpiredPublishes(now)
 	for _, msg := range s.unacknowledgedPublishes {
 		if msg.nextSendTime.Before(now) {
 			logger.Infof("Resending PUBLISH(%d)", msg.packetId)
 			msg.outstandingMessage.computeNextSendTime()
 			msg.dup = true
-			msg.toMessage().Send(s.conn)
+			s.writePublish(msg)
 		}
 	}
 	for _, msg := range s.unacknowledgedPubRels {
@@ -619,7 +1490,11 @@ func (s *Session) checkResend() {
 func (s *Session) Run() {
 	defer s.Close()
 
-	msg, _ := messages.ReadMessageWithTimeout(s.conn, 30*time.Second)
+	maxSize := int(s.server.config.MaximumPacketSize)
+	msg, err := messages.ReadMessageWithTimeout(s.conn, 30*time.Second, maxSize)
+	if err == messages.ErrPacketTooLarge {
+		logger.Infof("Session %d: CONNECT exceeds maximum packet size, closing connection", s.id)
+	}
 	if msg == nil {
 		return
 	}
@@ -642,7 +1517,7 @@ func (s *Session) Run() {
 	}()
 
 	for {
-		msg, err := messages.ReadMessageWithTimeout(s.conn, 30*time.Second)
+		msg, err := messages.ReadMessageWithTimeout(s.conn, 30*time.Second, maxSize)
 		s.lastMessageReceived = time.Now()
 		switch err {
 		case messages.ErrEof:
@@ -652,6 +1527,16 @@ func (s *Session) Run() {
 			break
 		case messages.ErrTimeout:
 			continue
+		case messages.ErrPacketTooLarge: // [MQTT5-3.2.2-15]
+			logger.Infof("Session %d: Packet exceeds maximum packet size, closing connection", s.id)
+			ticker.Stop()
+			s.disconnect(ReasonPacketTooLarge, "Packet exceeds maximum packet size")
+			return
+		case messages.ErrMalformedRemainingLength:
+			logger.Infof("Session %d: Malformed remaining length, closing connection", s.id)
+			ticker.Stop()
+			s.disconnect(ReasonMalformedPacket, "Malformed remaining length")
+			return
 		default:
 			logger.Infof("Unexpected error %v, terminating session", err)
 			ticker.Stop()
@@ -676,8 +1561,13 @@ func (s *Session) Run() {
 			s.handlePubComp(msg)
 		case messages.Disconnect:
 			s.handleDisconnect(msg)
-		default:
-			logger.Infof("Unhandled message: %+v", msg)
+		case messages.Auth:
+			s.handleAuth(msg)
+		default: // [MQTT-3.1.0-2], [MQTT5-4.13.1]
+			logger.Warningf("Unexpected packet type %d, closing connection", msg.Type)
+			ticker.Stop()
+			s.disconnect(ReasonProtocolError, "Unexpected packet type")
+			return
 		}
 	}
 }
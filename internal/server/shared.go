@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"sort"
+	"time"
+)
+
+// shareMember is a session subscribed to a shared subscription.
+type shareMember struct {
+	state *sessionState
+	sub   *Subscription
+}
+
+// inflight returns the number of messages sent to the member that are not
+// acknowledged yet, plus the messages queued while it is offline.
+func (m *shareMember) inflight() int {
+	m.state.lock.Lock()
+	defer m.state.lock.Unlock()
+	return len(m.state.unacknowledgedPublishes) + len(m.state.queuedMessages)
+}
+
+// sendToShareGroup sends om to one of the members of the shared subscription
+// filter [MQTT5-4.8.2]. Connected members are preferred; if all members are
+// offline, the message is queued for one of them. Returns false if there is
+// no member to send the message to.
+func (s *Server) sendToShareGroup(filter TopicFilter, members []shareMember, om *outstandingPublishMessage) bool {
+	var online, offline []shareMember
+	for _, m := range members {
+		m.state.lock.Lock()
+		connected := m.state.session != nil
+		m.state.lock.Unlock()
+		if connected {
+			online = append(online, m)
+		} else {
+			offline = append(offline, m)
+		}
+	}
+	candidates := online
+	if len(candidates) == 0 {
+		candidates = offline
+	}
+	if len(candidates) == 0 {
+		return false
+	}
+	m := s.pickShareMember(filter, candidates)
+	logger.Infof("Shared subscription %s: sending to client %s", filter, m.state.clientId)
+	s.deliver(m.state, om, m.sub)
+	return true
+}
+
+// pickShareMember chooses the member of the shared subscription filter that
+// receives the next message, according to the configured strategy.
+func (s *Server) pickShareMember(filter TopicFilter, candidates []shareMember) shareMember {
+	// Sessions are not kept in a stable order, so take turns by client id.
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].state.clientId < candidates[j].state.clientId
+	})
+	s.sharesLock.Lock()
+	turn := s.shareCounters[filter]
+	s.shareCounters[filter] = turn + 1
+	s.sharesLock.Unlock()
+
+	n := len(candidates)
+	best := candidates[turn%n]
+	if s.config.SharedSubscriptionStrategy == LeastInflight {
+		// Among equally busy members, the one whose turn it is wins.
+		least := best.inflight()
+		for i := 1; i < n; i++ {
+			m := candidates[(turn+i)%n]
+			if inflight := m.inflight(); inflight < least {
+				best, least = m, inflight
+			}
+		}
+	}
+	return best
+}
+
+// shareMembers returns the sessions subscribed to the shared subscription
+// filter.
+func (s *Server) shareMembers(filter TopicFilter) []shareMember {
+	var members []shareMember
+	for _, state := range s.sessionStates() {
+		state.lock.Lock()
+		sub, ok := state.subscriptions[filter]
+		state.lock.Unlock()
+		if ok {
+			members = append(members, shareMember{state, sub})
+		}
+	}
+	return members
+}
+
+// redistributeShared hands the messages that a terminated session received
+// through shared subscriptions, but did not acknowledge or did not get yet,
+// to the remaining members of the groups. It is called for the state of a
+// session that ends; persistent sessions keep their messages, which are sent
+// again when the client reconnects.
+func (s *Server) redistributeShared(state *sessionState) {
+	var pending []*outstandingPublishMessage
+	state.lock.Lock()
+	for packetId, msg := range state.unacknowledgedPublishes {
+		if msg.sharedFilter != "" {
+			pending = append(pending, msg)
+			delete(state.unacknowledgedPublishes, packetId)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].packetId < pending[j].packetId
+	})
+	for _, msg := range state.queuedMessages {
+		if msg.sharedFilter != "" {
+			pending = append(pending, msg)
+		}
+	}
+	state.queuedMessages = nil
+	state.lock.Unlock()
+	now := time.Now()
+	for _, msg := range pending {
+		if msg.expired(now) {
+			continue
+		}
+		logger.Infof("Client %s: Redistributing PUBLISH(%d) to shared subscription %s", state.clientId, msg.packetId, msg.sharedFilter)
+		om := *msg
+		om.dup = false
+		s.sendToShareGroup(msg.sharedFilter, s.shareMembers(msg.sharedFilter), &om)
+	}
+}
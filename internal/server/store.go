@@ -0,0 +1,393 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// StoredMessage is a PUBLISH message kept in a Store.
+type StoredMessage struct {
+	PacketId uint16    `json:"packet_id,omitempty"`
+	Topic    TopicName `json:"topic"`
+	Payload  []byte    `json:"payload,omitempty"`
+	QoS      uint8     `json:"qos,omitempty"`
+	Retain   bool      `json:"retain,omitempty"`
+	// Unix time when the message expires, 0 if it does not expire.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	// Encoded MQTT 5 properties forwarded to subscribers.
+	Properties []byte `json:"properties,omitempty"`
+	// Shared subscription the message was delivered through, if any.
+	SharedFilter TopicFilter `json:"shared_filter,omitempty"`
+}
+
+// StoredSession is the persistent state of a session with cleanSession == 0.
+type StoredSession struct {
+	ClientId string `json:"client_id"`
+	// Session Expiry Interval in seconds. 0 for sessions stored before the
+	// interval was recorded; they never expire.
+	ExpiryInterval uint32 `json:"expiry_interval,omitempty"`
+	// Subscription options as sent in SUBSCRIBE, keyed by topic filter. The
+	// lowest two bits are the QoS.
+	Subscriptions map[TopicFilter]uint8 `json:"subscriptions,omitempty"`
+	// QoS 1 and 2 messages sent to the client, but not acknowledged yet.
+	Publishes map[uint16]*StoredMessage `json:"publishes,omitempty"`
+	// Packet ids of PUBRELs sent to the client, but not acknowledged yet.
+	PubRels map[uint16]bool `json:"pub_rels,omitempty"`
+	// Packet ids of QoS 2 messages received from the client for which no
+	// PUBREL was received yet.
+	PubRecs map[uint16]bool `json:"pub_recs,omitempty"`
+	// Messages queued while the client was offline, oldest first.
+	Queue []*StoredMessage `json:"queue,omitempty"`
+}
+
+func newStoredSession(clientId string) *StoredSession {
+	return &StoredSession{
+		ClientId:      clientId,
+		Subscriptions: make(map[TopicFilter]uint8),
+		Publishes:     make(map[uint16]*StoredMessage),
+		PubRels:       make(map[uint16]bool),
+		PubRecs:       make(map[uint16]bool),
+	}
+}
+
+// Store persists the state of sessions with cleanSession == 0. The server
+// reports every change of such a session to its Store. Implementations are
+// MemoryStore and FileStore; see Config.SessionStore for running without a
+// Store.
+type Store interface {
+	// Load returns all stored sessions.
+	Load() ([]*StoredSession, error)
+
+	// AddSession creates an empty session for clientId, replacing an existing one.
+	AddSession(clientId string) error
+	DeleteSession(clientId string) error
+	// SetSessionExpiry records the Session Expiry Interval in seconds.
+	SetSessionExpiry(clientId string, interval uint32) error
+
+	// AddSubscription adds a subscription with the given options byte, see
+	// StoredSession.Subscriptions.
+	AddSubscription(clientId string, filter TopicFilter, options uint8) error
+	RemoveSubscription(clientId string, filter TopicFilter) error
+
+	// StorePublish and DeletePublish track QoS 1 and 2 messages sent to the client.
+	StorePublish(clientId string, msg *StoredMessage) error
+	DeletePublish(clientId string, packetId uint16) error
+	// StorePubRel and DeletePubRel track PUBRELs sent to the client.
+	StorePubRel(clientId string, packetId uint16) error
+	DeletePubRel(clientId string, packetId uint16) error
+	// StorePubRec and DeletePubRec track QoS 2 messages received from the client.
+	StorePubRec(clientId string, packetId uint16) error
+	DeletePubRec(clientId string, packetId uint16) error
+
+	// Enqueue appends msg to the queue of an offline session.
+	Enqueue(clientId string, msg *StoredMessage) error
+	// Dequeue removes the n oldest messages from the queue.
+	Dequeue(clientId string, n int) error
+
+	Close() error
+}
+
+const (
+	storeOpSession            = "session"
+	storeOpAddSession         = "add_session"
+	storeOpDeleteSession      = "delete_session"
+	storeOpSetSessionExpiry   = "set_session_expiry"
+	storeOpAddSubscription    = "add_subscription"
+	storeOpRemoveSubscription = "remove_subscription"
+	storeOpStorePublish       = "store_publish"
+	storeOpDeletePublish      = "delete_publish"
+	storeOpStorePubRel        = "store_pubrel"
+	storeOpDeletePubRel       = "delete_pubrel"
+	storeOpStorePubRec        = "store_pubrec"
+	storeOpDeletePubRec       = "delete_pubrec"
+	storeOpEnqueue            = "enqueue"
+	storeOpDequeue            = "dequeue"
+)
+
+// storeRecord describes a single change to a store.
+type storeRecord struct {
+	Op       string         `json:"op"`
+	ClientId string         `json:"client_id"`
+	Filter   TopicFilter    `json:"filter,omitempty"`
+	QoS      uint8          `json:"qos,omitempty"`
+	PacketId uint16         `json:"packet_id,omitempty"`
+	Count    int            `json:"count,omitempty"`
+	Interval uint32         `json:"interval,omitempty"`
+	Message  *StoredMessage `json:"message,omitempty"`
+	Session  *StoredSession `json:"session,omitempty"`
+}
+
+// MemoryStore is a Store that keeps all sessions in memory only. Sessions
+// are lost when the server shuts down, as without a Store, but they can be
+// inspected with Load.
+type MemoryStore struct {
+	lock     sync.Mutex
+	sessions map[string]*StoredSession
+
+	// Called with lock held for every change.
+	onUpdate func(r *storeRecord) error
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions: make(map[string]*StoredSession),
+	}
+}
+
+// apply applies r to the store's sessions. Must be called with s.lock held.
+func (s *MemoryStore) apply(r *storeRecord) error {
+	if r.Op == storeOpSession {
+		if r.Session == nil {
+			return fmt.Errorf("session record without session")
+		}
+		// Maps are omitted from JSON if empty
+		sess := newStoredSession(r.ClientId)
+		sess.ExpiryInterval = r.Session.ExpiryInterval
+		for filter, qos := range r.Session.Subscriptions {
+			sess.Subscriptions[filter] = qos
+		}
+		for packetId, msg := range r.Session.Publishes {
+			sess.Publishes[packetId] = msg
+		}
+		for packetId := range r.Session.PubRels {
+			sess.PubRels[packetId] = true
+		}
+		for packetId := range r.Session.PubRecs {
+			sess.PubRecs[packetId] = true
+		}
+		sess.Queue = r.Session.Queue
+		s.sessions[r.ClientId] = sess
+		return nil
+	}
+	if r.Op == storeOpAddSession {
+		s.sessions[r.ClientId] = newStoredSession(r.ClientId)
+		return nil
+	}
+	if (r.Op == storeOpStorePublish || r.Op == storeOpEnqueue) && r.Message == nil {
+		return fmt.Errorf("%s record without message", r.Op)
+	}
+	sess, ok := s.sessions[r.ClientId]
+	if !ok {
+		return fmt.Errorf("unknown client id %q", r.ClientId)
+	}
+	switch r.Op {
+	case storeOpDeleteSession:
+		delete(s.sessions, r.ClientId)
+	case storeOpSetSessionExpiry:
+		sess.ExpiryInterval = r.Interval
+	case storeOpAddSubscription:
+		sess.Subscriptions[r.Filter] = r.QoS
+	case storeOpRemoveSubscription:
+		delete(sess.Subscriptions, r.Filter)
+	case storeOpStorePublish:
+		sess.Publishes[r.Message.PacketId] = r.Message
+	case storeOpDeletePublish:
+		delete(sess.Publishes, r.PacketId)
+	case storeOpStorePubRel:
+		sess.PubRels[r.PacketId] = true
+	case storeOpDeletePubRel:
+		delete(sess.PubRels, r.PacketId)
+	case storeOpStorePubRec:
+		sess.PubRecs[r.PacketId] = true
+	case storeOpDeletePubRec:
+		delete(sess.PubRecs, r.PacketId)
+	case storeOpEnqueue:
+		sess.Queue = append(sess.Queue, r.Message)
+	case storeOpDequeue:
+		if r.Count > len(sess.Queue) {
+			r.Count = len(sess.Queue)
+		}
+		sess.Queue = sess.Queue[r.Count:]
+	default:
+		return fmt.Errorf("unknown op %q", r.Op)
+	}
+	return nil
+}
+
+func (s *MemoryStore) update(r *storeRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.apply(r); err != nil {
+		return err
+	}
+	if s.onUpdate != nil {
+		return s.onUpdate(r)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Load() ([]*StoredSession, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var res []*StoredSession
+	for _, sess := range s.sessions {
+		res = append(res, sess)
+	}
+	return res, nil
+}
+
+func (s *MemoryStore) AddSession(clientId string) error {
+	return s.update(&storeRecord{Op: storeOpAddSession, ClientId: clientId})
+}
+
+func (s *MemoryStore) DeleteSession(clientId string) error {
+	s.lock.Lock()
+	_, ok := s.sessions[clientId]
+	s.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	return s.update(&storeRecord{Op: storeOpDeleteSession, ClientId: clientId})
+}
+
+func (s *MemoryStore) SetSessionExpiry(clientId string, interval uint32) error {
+	return s.update(&storeRecord{Op: storeOpSetSessionExpiry, ClientId: clientId, Interval: interval})
+}
+
+func (s *MemoryStore) AddSubscription(clientId string, filter TopicFilter, options uint8) error {
+	return s.update(&storeRecord{Op: storeOpAddSubscription, ClientId: clientId, Filter: filter, QoS: options})
+}
+
+func (s *MemoryStore) RemoveSubscription(clientId string, filter TopicFilter) error {
+	return s.update(&storeRecord{Op: storeOpRemoveSubscription, ClientId: clientId, Filter: filter})
+}
+
+func (s *MemoryStore) StorePublish(clientId string, msg *StoredMessage) error {
+	return s.update(&storeRecord{Op: storeOpStorePublish, ClientId: clientId, Message: msg})
+}
+
+func (s *MemoryStore) DeletePublish(clientId string, packetId uint16) error {
+	return s.update(&storeRecord{Op: storeOpDeletePublish, ClientId: clientId, PacketId: packetId})
+}
+
+func (s *MemoryStore) StorePubRel(clientId string, packetId uint16) error {
+	return s.update(&storeRecord{Op: storeOpStorePubRel, ClientId: clientId, PacketId: packetId})
+}
+
+func (s *MemoryStore) DeletePubRel(clientId string, packetId uint16) error {
+	return s.update(&storeRecord{Op: storeOpDeletePubRel, ClientId: clientId, PacketId: packetId})
+}
+
+func (s *MemoryStore) StorePubRec(clientId string, packetId uint16) error {
+	return s.update(&storeRecord{Op: storeOpStorePubRec, ClientId: clientId, PacketId: packetId})
+}
+
+func (s *MemoryStore) DeletePubRec(clientId string, packetId uint16) error {
+	return s.update(&storeRecord{Op: storeOpDeletePubRec, ClientId: clientId, PacketId: packetId})
+}
+
+func (s *MemoryStore) Enqueue(clientId string, msg *StoredMessage) error {
+	return s.update(&storeRecord{Op: storeOpEnqueue, ClientId: clientId, Message: msg})
+}
+
+func (s *MemoryStore) Dequeue(clientId string, n int) error {
+	return s.update(&storeRecord{Op: storeOpDequeue, ClientId: clientId, Count: n})
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// FileStore is a Store that appends every change to a log file. The log is
+// compacted periodically by replacing it with one record per session.
+type FileStore struct {
+	MemoryStore
+	journal *journal
+
+	stop chan bool
+}
+
+// NewFileStore opens the session log at path. Every compactionInterval, the
+// log is compacted if it contains considerably more records than sessions.
+func NewFileStore(path string, compactionInterval time.Duration) (*FileStore, error) {
+	s := &FileStore{
+		MemoryStore: MemoryStore{
+			sessions: make(map[string]*StoredSession),
+		},
+		stop: make(chan bool),
+	}
+	j, err := openJournal(path, func(data []byte) error {
+		var r storeRecord
+		if err := decodeRecord(data, &r); err != nil {
+			return err
+		}
+		return s.apply(&r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.journal = j
+	s.onUpdate = func(r *storeRecord) error {
+		return j.append(r)
+	}
+	if compactionInterval > 0 {
+		go s.compactPeriodically(compactionInterval)
+	}
+	return s, nil
+}
+
+func (s *FileStore) compactPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.compactIfNeeded(); err != nil {
+				logger.Warningf("Can't compact session store: %s", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *FileStore) compactIfNeeded() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.journal.size() <= 2*len(s.sessions)+100 {
+		return nil
+	}
+	return s.compact()
+}
+
+// compact must be called with s.lock held.
+func (s *FileStore) compact() error {
+	logger.Infof("Compacting session store")
+	return s.journal.compact(func(write func(record interface{}) error) error {
+		for clientId, sess := range s.sessions {
+			if err := write(&storeRecord{Op: storeOpSession, ClientId: clientId, Session: sess}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *FileStore) Close() error {
+	close(s.stop)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.compact(); err != nil {
+		logger.Warningf("Can't compact session store: %s", err)
+	}
+	return s.journal.close()
+}
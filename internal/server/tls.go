@@ -0,0 +1,229 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CertIdentitySource determines which part of a client certificate is used
+// as the client's identity.
+type CertIdentitySource int
+
+const (
+	CertIdentityNone CertIdentitySource = iota
+	CertIdentityCommonName
+	// The first DNS name subject alternative name
+	CertIdentityDNSName
+	// The first email subject alternative name
+	CertIdentityEmail
+	// The first URI subject alternative name
+	CertIdentityURI
+)
+
+var certIdentitySources = map[string]CertIdentitySource{
+	"":      CertIdentityNone,
+	"cn":    CertIdentityCommonName,
+	"dns":   CertIdentityDNSName,
+	"email": CertIdentityEmail,
+	"uri":   CertIdentityURI,
+}
+
+// ParseCertIdentitySource parses one of "cn", "dns", "email", or "uri".
+func ParseCertIdentitySource(s string) (CertIdentitySource, error) {
+	if src, ok := certIdentitySources[s]; ok {
+		return src, nil
+	}
+	return CertIdentityNone, fmt.Errorf("unknown certificate identity source %q", s)
+}
+
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// If set, client certificates are verified against the CAs in this file.
+	CAFile string
+	// If true, clients must present a certificate signed by a CA in CAFile.
+	RequireClientCert bool
+	// Which part of a client certificate identifies the client.
+	IdentitySource CertIdentitySource
+	// If true, the certificate's identity is used as the client's user name.
+	// Such clients are considered authenticated by their certificate, and
+	// the server's Authenticator is not consulted.
+	IdentityAsUsername bool
+	// If true, the certificate's identity is used as the client id, and the
+	// client id sent in CONNECT is ignored.
+	IdentityAsClientId bool
+	// Minimum TLS version, e.g. tls.VersionTLS12. If 0, Go's default is used.
+	MinVersion uint16
+	// Allowed cipher suites for TLS 1.0 - 1.2. If empty, Go's defaults are used.
+	CipherSuites []uint16
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses a TLS version like "1.2".
+func ParseTLSVersion(s string) (uint16, error) {
+	if v, ok := tlsVersions[s]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", s)
+}
+
+// ParseCipherSuites parses a comma separated list of cipher suite names like
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+func ParseCipherSuites(s string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+	var res []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		res = append(res, id)
+	}
+	return res, nil
+}
+
+// tlsConfigLoader builds a tls.Config from a TLSConfig. The certificate files
+// are re-read on reload; connections established before keep using the old
+// certificates.
+type tlsConfigLoader struct {
+	config  *TLSConfig
+	current atomic.Value // *tls.Config
+}
+
+func newTLSConfigLoader(config *TLSConfig) (*tlsConfigLoader, error) {
+	l := &tlsConfigLoader{config: config}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *tlsConfigLoader) reload() error {
+	cert, err := tls.LoadX509KeyPair(l.config.CertFile, l.config.KeyFile)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   l.config.MinVersion,
+		CipherSuites: l.config.CipherSuites,
+	}
+	if l.config.RequireClientCert && l.config.CAFile == "" {
+		return fmt.Errorf("client certificates required, but no CA file given")
+	}
+	if l.config.CAFile != "" {
+		pem, err := ioutil.ReadFile(l.config.CAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", l.config.CAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if l.config.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	l.current.Store(tlsConfig)
+	logger.Infof("Loaded TLS certificate from %s", l.config.CertFile)
+	return nil
+}
+
+// serverConfig returns a tls.Config for listeners that always uses the most
+// recently loaded certificates.
+func (l *tlsConfigLoader) serverConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return l.current.Load().(*tls.Config), nil
+		},
+	}
+}
+
+// certificateIdentity returns the identity of a client certificate, or ""
+// if the certificate doesn't contain the requested field.
+func certificateIdentity(cert *x509.Certificate, source CertIdentitySource) string {
+	switch source {
+	case CertIdentityCommonName:
+		return cert.Subject.CommonName
+	case CertIdentityDNSName:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case CertIdentityEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case CertIdentityURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	}
+	return ""
+}
+
+// handshake performs the TLS handshake on conn and returns the identity of
+// the client's certificate, if any. Fails if the client didn't present a
+// valid certificate although one is required.
+func (config *TLSConfig) handshake(conn *tls.Conn, timeout time.Duration) (string, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := conn.Handshake(); err != nil {
+		return "", err
+	}
+	return config.identity(conn.ConnectionState())
+}
+
+// identity returns the identity of the client's certificate of an
+// established TLS connection, see handshake.
+func (config *TLSConfig) identity(state tls.ConnectionState) (string, error) {
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		if config.RequireClientCert {
+			return "", fmt.Errorf("no client certificate")
+		}
+		return "", nil
+	}
+	identity := certificateIdentity(certs[0], config.IdentitySource)
+	if identity == "" && config.IdentitySource != CertIdentityNone {
+		return "", fmt.Errorf("client certificate %q has no identity", certs[0].Subject)
+	}
+	return identity, nil
+}
@@ -22,10 +22,6 @@ import (
 	"strings"
 )
 
-var (
-	topics TopicList
-)
-
 type TopicName string
 type TopicFilter string
 type Topic struct {
@@ -52,6 +48,45 @@ func split(s string) []string {
 	return res
 }
 
+// sharePrefix starts the topic filter of a shared subscription,
+// "$share/<group>/<filter>" [MQTT5-4.8.2].
+const sharePrefix = "$share/"
+
+// shared splits the filter of a shared subscription into the share name and
+// the actual topic filter. ok is false if f is an ordinary topic filter.
+func (f *TopicFilter) shared() (group string, filter TopicFilter, ok bool) {
+	if !strings.HasPrefix(string(*f), sharePrefix) {
+		return "", *f, false
+	}
+	rest := string(*f)[len(sharePrefix):]
+	i := strings.IndexByte(rest, '/')
+	if i < 0 {
+		return rest, "", true
+	}
+	return rest[:i], TopicFilter(rest[i+1:]), true
+}
+
+// valid returns whether f is a syntactically correct topic filter.
+func (f *TopicFilter) valid() bool {
+	if group, filter, ok := f.shared(); ok {
+		// [MQTT5-4.8.2-1], [MQTT5-4.8.2-2]
+		return group != "" && !strings.ContainsAny(group, "+#") && filter.valid()
+	}
+	if len(*f) == 0 || strings.ContainsRune(string(*f), 0) { // [MQTT-4.7.3-1], [MQTT-4.7.3-2]
+		return false
+	}
+	parts := split(string(*f))
+	for i, p := range parts {
+		if strings.Contains(p, "#") && (p != "#" || i != len(parts)-1) { // [MQTT-4.7.1-2]
+			return false
+		}
+		if strings.Contains(p, "+") && p != "+" { // [MQTT-4.7.1-3]
+			return false
+		}
+	}
+	return true
+}
+
 func (f *TopicFilter) matches(t TopicName) bool {
 	filterParts := split(string(*f))
 	nameParts := split(string(t))
@@ -66,7 +101,7 @@ func (f *TopicFilter) matches(t TopicName) bool {
 		if p == "#" {
 			return true
 		}
-		if len(nameParts) < i {
+		if len(nameParts) <= i {
 			// not enough name parts
 			return false
 		}
@@ -74,12 +109,50 @@ func (f *TopicFilter) matches(t TopicName) bool {
 			return false
 		}
 	}
-	return true
+	return len(filterParts) == len(nameParts)
+}
+
+// covers returns whether every topic name matched by other is also matched
+// by f.
+func (f *TopicFilter) covers(other TopicFilter) bool {
+	if !strings.ContainsAny(string(other), "+#") {
+		return f.matches(TopicName(other))
+	}
+	filterParts := split(string(*f))
+	otherParts := split(string(other))
+
+	if (strings.HasPrefix(filterParts[0], "+") || strings.HasPrefix(filterParts[0], "#")) && strings.HasPrefix(otherParts[0], "$") {
+		// [MQTT-4.7.2-1]
+		return false
+	}
+
+	for i := 0; i < len(filterParts); i++ {
+		p := filterParts[i]
+		if p == "#" {
+			return true
+		}
+		if len(otherParts) <= i || otherParts[i] == "#" {
+			return false
+		}
+		if p != "+" && (otherParts[i] == "+" || p != otherParts[i]) {
+			return false
+		}
+	}
+	return len(filterParts) == len(otherParts)
+}
+
+func (l *TopicList) find(name TopicName) *Topic {
+	for _, topic := range *l {
+		if topic.name == name {
+			return topic
+		}
+	}
+	return nil
 }
 
 func (l *TopicList) filter(filter TopicFilter) TopicList {
 	var res TopicList
-	for _, topic := range topics {
+	for _, topic := range *l {
 		if filter.matches(topic.name) {
 			res = append(res, topic)
 		}
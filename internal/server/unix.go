@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// UnixSocketConfig contains the options of Unix domain socket listeners.
+type UnixSocketConfig struct {
+	// File mode of the socket, e.g. 0660. If 0, the mode is determined by
+	// the umask.
+	Mode os.FileMode
+	// Owner and group of the socket. -1 leaves them unchanged.
+	Uid int
+	Gid int
+}
+
+// PeerCredentials identify the process at the other end of a Unix domain
+// socket.
+type PeerCredentials struct {
+	Pid int
+	Uid int
+	Gid int
+}
+
+// listenUnix listens on the Unix domain socket at path. A socket left over
+// by a previous run is removed first.
+func listenUnix(path string, config *UnixSocketConfig) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return listener, nil
+	}
+	if config.Mode != 0 {
+		if err := os.Chmod(path, config.Mode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	if config.Uid != -1 || config.Gid != -1 {
+		if err := os.Chown(path, config.Uid, config.Gid); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket at path if nobody is listening on it
+// anymore. Fails if path is in use or is not a socket.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	if opErr, ok := err.(*net.OpError); !ok || !isConnRefused(opErr.Err) {
+		return err
+	}
+	logger.Infof("Removing stale socket %s", path)
+	return os.Remove(path)
+}
+
+func isConnRefused(err error) bool {
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return err == syscall.ECONNREFUSED
+}
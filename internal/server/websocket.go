@@ -0,0 +1,292 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type WebSocketConfig struct {
+	// HTTP path clients connect to, e.g. "/mqtt". If empty, all paths are
+	// accepted.
+	Path string
+	// Origins browsers may connect from, e.g. "https://dashboard.example.com".
+	// If empty, all origins are accepted.
+	AllowedOrigins []string
+}
+
+var errListenerClosed = errors.New("listener closed")
+
+// webSocketChunkSize is the largest part of a WebSocket message that is
+// read into memory at once.
+const webSocketChunkSize = 4096
+
+// webSocketListener is a net.Listener that accepts MQTT over WebSocket
+// connections, so that they can be served like plain TCP connections.
+type webSocketListener struct {
+	config   *WebSocketConfig
+	listener net.Listener
+	server   *http.Server
+	upgrader websocket.Upgrader
+
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newWebSocketListener(config *WebSocketConfig, listener net.Listener) *webSocketListener {
+	l := &webSocketListener{
+		config:   config,
+		listener: listener,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	l.upgrader = websocket.Upgrader{
+		// [MQTT-6.0.0-3]
+		Subprotocols: []string{"mqtt", "mqttv3.1"},
+		CheckOrigin:  l.checkOrigin,
+	}
+	l.server = &http.Server{Handler: l}
+	go l.server.Serve(listener)
+	return l
+}
+
+func (l *webSocketListener) checkOrigin(r *http.Request) bool {
+	if len(l.config.AllowedOrigins) == 0 {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	for _, allowed := range l.config.AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *webSocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if l.config.Path != "" && r.URL.Path != l.config.Path {
+		http.NotFound(w, r)
+		return
+	}
+	ws, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Infof("WebSocket upgrade from %s failed: %s", r.RemoteAddr, err)
+		return
+	}
+	if ws.Subprotocol() == "" {
+		logger.Infof("WebSocket client %s didn't request the mqtt subprotocol, closing connection", r.RemoteAddr)
+		ws.Close()
+		return
+	}
+	conn := newWebSocketConn(ws)
+	conn.tlsState = r.TLS
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *webSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *webSocketListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.server.Close()
+	})
+	return err
+}
+
+func (l *webSocketListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// webSocketConn adapts a WebSocket connection to net.Conn. MQTT packets are
+// sent as binary messages; a message may contain any part of the packet
+// stream [MQTT-6.0.0-2].
+//
+// Messages are read by a background goroutine: a read timeout would leave
+// the underlying WebSocket connection unusable, but Session relies on reads
+// timing out regularly. It passes them on in chunks of at most
+// webSocketChunkSize bytes, so a large message is never held in memory as a
+// whole; the maximum packet size is enforced on the packet stream, like for
+// TCP connections.
+type webSocketConn struct {
+	ws *websocket.Conn
+	// State of the TLS connection the WebSocket runs on, nil for ws.
+	tlsState *tls.ConnectionState
+
+	frames    chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	readErr   error // valid once frames is closed
+	pending   []byte
+
+	deadlineLock sync.Mutex
+	readDeadline time.Time
+
+	writeLock sync.Mutex
+}
+
+func newWebSocketConn(ws *websocket.Conn) *webSocketConn {
+	c := &webSocketConn{
+		ws:     ws,
+		frames: make(chan []byte),
+		closed: make(chan struct{}),
+	}
+	go c.readFrames()
+	return c
+}
+
+func (c *webSocketConn) readFrames() {
+	defer close(c.frames)
+	for {
+		msgType, r, err := c.ws.NextReader()
+		if err != nil {
+			c.readErr = webSocketReadError(err)
+			return
+		}
+		if msgType != websocket.BinaryMessage {
+			// [MQTT-6.0.0-1]
+			logger.Infof("WebSocket client %s sent a non-binary message, closing connection", c.RemoteAddr())
+			c.readErr = io.EOF
+			c.ws.Close()
+			return
+		}
+		for {
+			data := make([]byte, webSocketChunkSize)
+			n, err := r.Read(data)
+			if n > 0 {
+				select {
+				case c.frames <- data[:n]:
+				case <-c.closed:
+					c.readErr = io.EOF
+					return
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				c.readErr = webSocketReadError(err)
+				return
+			}
+		}
+	}
+}
+
+// webSocketReadError maps a close of the WebSocket connection by the client
+// to io.EOF.
+func webSocketReadError(err error) error {
+	if _, ok := err.(*websocket.CloseError); ok {
+		return io.EOF
+	}
+	return err
+}
+
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		c.deadlineLock.Lock()
+		deadline := c.readDeadline
+		c.deadlineLock.Unlock()
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case data, ok := <-c.frames:
+			if !ok {
+				return 0, c.readErr
+			}
+			c.pending = data
+		case <-timeout:
+			return 0, timeoutError{}
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *webSocketConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *webSocketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.ws.Close()
+	})
+	return err
+}
+
+func (c *webSocketConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *webSocketConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+func (c *webSocketConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
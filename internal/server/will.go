@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2022 Andreas Signer <asigner@gmail.com>
+ *
+ * This file is part of mqttlite.
+ *
+ * mqttlite is free software: you can redistribute it and/or
+ * modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * mqttlite is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with mqttlite.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"time"
+)
+
+// delayedWill is a will message that is published when its delay interval
+// has passed, unless the client reconnects first [MQTT5-3.1.3-9].
+type delayedWill struct {
+	timer *time.Timer
+	sess  *Session // the connection the will belongs to
+	will  *will
+}
+
+// willDelay returns how long the will is held back after the connection
+// closed: the will delay interval, but no longer than the session exists
+// [MQTT5-3.1.2-8].
+func (s *Session) willDelay() time.Duration {
+	if s.will.properties == nil || s.sessionState == nil {
+		return 0
+	}
+	delay := s.will.properties.WillDelayInterval
+	s.lock.Lock()
+	if s.expiryInterval < delay {
+		delay = s.expiryInterval
+	}
+	s.lock.Unlock()
+	return time.Duration(delay) * time.Second
+}
+
+// publishWill publishes w, the will of the session's client.
+func (s *Session) publishWill(w *will) {
+	logger.Infof("Session %d: Publishing will to %s", s.id, w.topic)
+	om := s.newOutstandingPublishMessage(w.topic, w.data, w.retain, w.qos)
+	om.expiresAt = s.messageExpiry(w.properties)
+	om.properties = forwardedProperties(w.properties)
+	s.sendToSubscribers(om)
+}
+
+// delayWill publishes w after delay, unless the client reconnects or the
+// session ends before.
+func (s *Session) delayWill(w *will, delay time.Duration) {
+	logger.Infof("Session %d: Delaying will by %s", s.id, delay)
+	state := s.sessionState
+	dw := &delayedWill{sess: s, will: w}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	state.delayedWill = dw
+	dw.timer = time.AfterFunc(delay, state.publishDelayedWill)
+}
+
+// takeDelayedWill removes the delayed will from the state and returns it,
+// or nil if there is none.
+func (s *sessionState) takeDelayedWill() *delayedWill {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	dw := s.delayedWill
+	if dw != nil {
+		dw.timer.Stop()
+		s.delayedWill = nil
+	}
+	return dw
+}
+
+// publishDelayedWill publishes the delayed will right away, if there is one.
+func (s *sessionState) publishDelayedWill() {
+	if dw := s.takeDelayedWill(); dw != nil {
+		dw.sess.publishWill(dw.will)
+	}
+}
+
+// resolveDelayedWill deals with the delayed will of a client that connects
+// again: if the client resumes its session, the will is discarded
+// [MQTT5-3.1.3-9]. If it starts a new session, the old one ends, and the
+// will is published now.
+func (s *Server) resolveDelayedWill(clientId string, cleanStart bool) {
+	s.sessionsLock.Lock()
+	state := s.persistentSessions[clientId]
+	s.sessionsLock.Unlock()
+	if state == nil {
+		return
+	}
+	if cleanStart {
+		state.publishDelayedWill()
+	} else if state.takeDelayedWill() != nil {
+		logger.Infof("Client %s reconnected, discarding its will", clientId)
+	}
+}
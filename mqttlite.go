@@ -20,6 +20,14 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/asig/go-logging/logging"
 
@@ -29,17 +37,322 @@ import (
 var (
 	logger *logging.Logger
 
-	flagAddress = flag.String("address", ":1883", "Address to listen on, e.g. localhost:1883. If only a port is specified, the server will listen on all addresses.")
+	flagAddress             = flag.String("address", ":1883", "Address to listen on, e.g. localhost:1883. If only a port is specified, the server will listen on all addresses. Use unix:<path> to listen on a Unix domain socket.")
+	flagTLSAddress          = flag.String("tls_address", "", "Address to listen on for TLS connections, e.g. :8883. If empty, TLS is disabled unless given with -listener.")
+	flagTLSCert             = flag.String("tls_cert", "", "PEM file with the server certificate (chain).")
+	flagTLSKey              = flag.String("tls_key", "", "PEM file with the server certificate's private key.")
+	flagTLSCA               = flag.String("tls_ca", "", "PEM file with CA certificates to verify client certificates with.")
+	flagTLSRequireCert      = flag.Bool("tls_require_client_cert", false, "Refuse TLS clients without a certificate signed by a CA in -tls_ca.")
+	flagTLSIdentity         = flag.String("tls_identity", "", "Which part of a client certificate identifies the client: cn, dns, email, or uri. If empty, certificates are not used as identity.")
+	flagTLSIdentityAs       = flag.String("tls_identity_as", "username", "What the certificate identity is used as: username, clientid, or both. Clients identified by user name are not checked against -password_file.")
+	flagTLSMinVersion       = flag.String("tls_min_version", "1.2", "Minimum TLS version: 1.0, 1.1, 1.2, or 1.3.")
+	flagTLSCipherSuites     = flag.String("tls_cipher_suites", "", "Comma separated list of allowed cipher suites for TLS 1.2 and below. If empty, Go's defaults are used.")
+	flagWSAddress           = flag.String("ws_address", "", "Address to listen on for MQTT over WebSocket connections, e.g. :8080. If empty, WebSockets are disabled.")
+	flagWSPath              = flag.String("ws_path", "/mqtt", "HTTP path WebSocket clients connect to.")
+	flagWSAllowedOrigins    = flag.String("ws_allowed_origins", "", "Comma separated list of origins browsers may connect from. If empty, all origins are accepted.")
+	flagSocketMode          = flag.String("socket_mode", "", "File mode of Unix domain sockets, e.g. 0660. If empty, the umask applies.")
+	flagSocketOwner         = flag.String("socket_owner", "", "User name or uid that owns Unix domain sockets. If empty, the owner is not changed.")
+	flagSocketGroup         = flag.String("socket_group", "", "Group name or gid of Unix domain sockets. If empty, the group is not changed.")
+	flagPasswordFile        = flag.String("password_file", "", "File with user names and bcrypt, argon2, or SCRAM-SHA-256 password hashes, one \"user:hash\" per line. Users with SCRAM-SHA-256 hashes can also use MQTT 5 enhanced authentication. If empty, all clients are accepted.")
+	flagAllowAnonymous      = flag.Bool("allow_anonymous", false, "Accept clients without user name even if -password_file is set.")
+	flagACLFile             = flag.String("acl_file", "", "File with topic access rules. If empty, all clients may access all topics.")
+	flagMaxQueuedMessages   = flag.Int("max_queued_messages", 0, "Maximum number of QoS 1 and 2 messages queued for a disconnected persistent session, or for a connected client that has not acknowledged -receive_maximum messages yet. 0 means no limit.")
+	flagQueueOverflowPolicy = flag.String("queue_overflow_policy", "drop-oldest", "What to do if the queue of a session is full: drop-oldest, drop-newest, or disconnect (discard the session and disconnect the client).")
+	flagReceiveMaximum      = flag.Int("receive_maximum", 0, "Maximum number of unacknowledged QoS 1 and 2 messages sent to an MQTT 3.1 or 3.1.1 client; further messages are queued until the client acknowledges some. MQTT 5 clients set their own receive maximum. 0 means no limit.")
+	flagDefaultMessageTTL   = flag.Duration("default_message_ttl", 0, "How long messages from MQTT 3.1 and 3.1.1 clients are kept for offline clients and as retained messages, e.g. 1h. MQTT 5 clients set the expiry per message. 0 means forever.")
+	flagSessionExpiry       = flag.Duration("session_expiry", 0, "How long persistent sessions of MQTT 3.1 and 3.1.1 clients are kept after they disconnect, e.g. 24h. MQTT 5 clients set their own session expiry interval. 0 means forever.")
+	flagMaxPacketSize       = flag.Uint("max_packet_size", 0, "Size in bytes of the largest packet clients may send; connections sending larger packets are closed. 0 means the protocol's limit of 256 MB.")
+	flagTopicAliasMaximum   = flag.Uint("topic_alias_maximum", 10, "Number of topic aliases MQTT 5 clients may use when publishing. 0 disables topic aliases sent by clients.")
+	flagSharedStrategy      = flag.String("shared_subscription_strategy", "round-robin", "How messages are distributed among the members of a shared subscription ($share/<group>/<filter>): round-robin, or least-inflight (the member with the fewest unacknowledged messages).")
+	flagRetainedStore       = flag.String("retained_store", "", "File to persist retained messages in. If empty, retained messages are lost when the server shuts down.")
+	flagSessionStore        = flag.String("session_store", "", "File to persist sessions in. If empty, sessions are lost when the server shuts down.")
+	flagCompactionInterval  = flag.Duration("compaction_interval", 10*time.Minute, "How often the persistent stores are compacted.")
+	flagServerReference     = flag.String("server_reference", "", "Server that MQTT 5 clients are redirected to when the server is drained with SIGUSR1 (not available on Windows), e.g. other.example.com:1883.")
+	flagServerMoved         = flag.Bool("server_moved", false, "Tell clients redirected by SIGUSR1 that the server moved permanently instead of temporarily.")
 )
 
+// listenerFlags collects the values of the repeatable -listener flag.
+type listenerFlags []string
+
+func (f *listenerFlags) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *listenerFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+var flagListeners listenerFlags
+
 func init() {
+	flag.Var(&flagListeners, "listener", "Additional listener, given as comma separated key=value pairs. Keys: type (tcp, tls, ws, wss, or unix), address, path (for ws and wss), mode, owner, and group (for unix, default to the -socket_* flags), proxy_protocol (true to expect PROXY protocol v1/v2 headers), max_connections, max_connections_per_host, password_file, allow_anonymous, acl_file. TLS listeners use the -tls_* flags. Can be repeated.")
 	flag.Parse()
 	logging.Initialize()
 	logger = logging.Get("main")
 	server.Init()
 }
 
+var sharedTLSConfig *server.TLSConfig
+
+// tlsConfig returns the TLS configuration given by the -tls_* flags.
+func tlsConfig() *server.TLSConfig {
+	if sharedTLSConfig != nil {
+		return sharedTLSConfig
+	}
+	config := &server.TLSConfig{
+		CertFile: *flagTLSCert,
+		KeyFile:  *flagTLSKey,
+		CAFile:   *flagTLSCA,
+
+		RequireClientCert: *flagTLSRequireCert,
+	}
+	var err error
+	if config.IdentitySource, err = server.ParseCertIdentitySource(*flagTLSIdentity); err != nil {
+		logger.Fatalf("Invalid -tls_identity: %s", err)
+	}
+	switch *flagTLSIdentityAs {
+	case "username":
+		config.IdentityAsUsername = true
+	case "clientid":
+		config.IdentityAsClientId = true
+	case "both":
+		config.IdentityAsUsername = true
+		config.IdentityAsClientId = true
+	default:
+		logger.Fatalf("Invalid -tls_identity_as: %q", *flagTLSIdentityAs)
+	}
+	if config.MinVersion, err = server.ParseTLSVersion(*flagTLSMinVersion); err != nil {
+		logger.Fatalf("Invalid -tls_min_version: %s", err)
+	}
+	if config.CipherSuites, err = server.ParseCipherSuites(*flagTLSCipherSuites); err != nil {
+		logger.Fatalf("Invalid -tls_cipher_suites: %s", err)
+	}
+	sharedTLSConfig = config
+	return config
+}
+
+// webSocketConfig returns the WebSocket configuration given by the -ws_*
+// flags. If path is not empty, it overrides -ws_path.
+func webSocketConfig(path string) *server.WebSocketConfig {
+	if path == "" {
+		path = *flagWSPath
+	}
+	config := &server.WebSocketConfig{Path: path}
+	for _, origin := range strings.Split(*flagWSAllowedOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			config.AllowedOrigins = append(config.AllowedOrigins, origin)
+		}
+	}
+	return config
+}
+
+// unixSocketConfig returns the options for Unix domain sockets. Empty
+// arguments default to the -socket_* flags.
+func unixSocketConfig(mode, owner, group string) (*server.UnixSocketConfig, error) {
+	if mode == "" {
+		mode = *flagSocketMode
+	}
+	if owner == "" {
+		owner = *flagSocketOwner
+	}
+	if group == "" {
+		group = *flagSocketGroup
+	}
+	config := &server.UnixSocketConfig{Uid: -1, Gid: -1}
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socket mode %q", mode)
+		}
+		config.Mode = os.FileMode(m)
+	}
+	if owner != "" {
+		uid, err := strconv.Atoi(owner)
+		if err != nil {
+			u, err := user.Lookup(owner)
+			if err != nil {
+				return nil, err
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+		config.Uid = uid
+	}
+	if group != "" {
+		gid, err := strconv.Atoi(group)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return nil, err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+		config.Gid = gid
+	}
+	return config, nil
+}
+
+// parseListener parses the value of a -listener flag, e.g.
+// "type=tls,address=:8883,max_connections=100,acl_file=devices.acl".
+func parseListener(spec string) (*server.ListenerConfig, error) {
+	options := make(map[string]string)
+	for _, option := range strings.Split(spec, ",") {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%q is not a key=value pair", option)
+		}
+		options[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	listener := &server.ListenerConfig{Address: options["address"]}
+	if listener.Address == "" {
+		return nil, fmt.Errorf("address missing")
+	}
+	switch options["type"] {
+	case "tcp", "":
+		listener.Type = server.TCPListener
+	case "tls":
+		listener.Type = server.TCPListener
+		listener.TLS = tlsConfig()
+	case "ws":
+		listener.Type = server.WebSocketListener
+		listener.WebSocket = webSocketConfig(options["path"])
+	case "wss":
+		listener.Type = server.WebSocketListener
+		listener.WebSocket = webSocketConfig(options["path"])
+		listener.TLS = tlsConfig()
+	case "unix":
+		listener.Type = server.UnixListener
+		unixConfig, err := unixSocketConfig(options["mode"], options["owner"], options["group"])
+		if err != nil {
+			return nil, err
+		}
+		listener.Unix = unixConfig
+	default:
+		return nil, fmt.Errorf("unknown type %q", options["type"])
+	}
+	listener.ProxyProtocol = options["proxy_protocol"] == "true"
+	var err error
+	if s := options["max_connections"]; s != "" {
+		if listener.MaxConnections, err = strconv.Atoi(s); err != nil {
+			return nil, fmt.Errorf("invalid max_connections: %s", err)
+		}
+	}
+	if s := options["max_connections_per_host"]; s != "" {
+		if listener.MaxConnectionsPerHost, err = strconv.Atoi(s); err != nil {
+			return nil, fmt.Errorf("invalid max_connections_per_host: %s", err)
+		}
+	}
+	if path := options["password_file"]; path != "" {
+		allowAnonymous := options["allow_anonymous"] == "true"
+		passwords, err := server.NewPasswordFileAuthenticator(path, allowAnonymous)
+		if err != nil {
+			return nil, fmt.Errorf("can't read password file: %s", err)
+		}
+		listener.Authenticator = passwords
+		listener.AuthMethods = map[string]server.AuthMethod{
+			server.ScramSHA256: server.NewScramSHA256(passwords),
+		}
+	}
+	if path := options["acl_file"]; path != "" {
+		if listener.Authorizer, err = server.NewACLFile(path); err != nil {
+			return nil, fmt.Errorf("can't read ACL file: %s", err)
+		}
+	}
+	return listener, nil
+}
+
 func main() {
-	srv := server.New(*flagAddress)
-	srv.Start()
+	overflowPolicy, err := server.ParseOverflowPolicy(*flagQueueOverflowPolicy)
+	if err != nil {
+		logger.Fatalf("Invalid -queue_overflow_policy: %s", err)
+	}
+	sharedStrategy, err := server.ParseShareStrategy(*flagSharedStrategy)
+	if err != nil {
+		logger.Fatalf("Invalid -shared_subscription_strategy: %s", err)
+	}
+	if *flagMaxPacketSize > 4294967295 {
+		logger.Fatalf("Invalid -max_packet_size: %d is larger than 4294967295", *flagMaxPacketSize)
+	}
+	if *flagTopicAliasMaximum > 65535 {
+		logger.Fatalf("Invalid -topic_alias_maximum: %d is larger than 65535", *flagTopicAliasMaximum)
+	}
+	config := server.Config{
+		MaxQueuedMessages:          *flagMaxQueuedMessages,
+		QueueOverflowPolicy:        overflowPolicy,
+		ReceiveMaximum:             *flagReceiveMaximum,
+		DefaultMessageTTL:          *flagDefaultMessageTTL,
+		DefaultSessionExpiry:       *flagSessionExpiry,
+		MaximumPacketSize:          uint32(*flagMaxPacketSize),
+		TopicAliasMaximum:          uint16(*flagTopicAliasMaximum),
+		SharedSubscriptionStrategy: sharedStrategy,
+	}
+	if strings.HasPrefix(*flagAddress, "unix:") {
+		unixConfig, err := unixSocketConfig("", "", "")
+		if err != nil {
+			logger.Fatalf("Invalid socket options: %s", err)
+		}
+		config.Listeners = append(config.Listeners, &server.ListenerConfig{Type: server.UnixListener, Address: strings.TrimPrefix(*flagAddress, "unix:"), Unix: unixConfig})
+	} else if *flagAddress != "" {
+		config.Listeners = append(config.Listeners, &server.ListenerConfig{Type: server.TCPListener, Address: *flagAddress})
+	}
+	if *flagTLSAddress != "" {
+		config.Listeners = append(config.Listeners, &server.ListenerConfig{Type: server.TCPListener, Address: *flagTLSAddress, TLS: tlsConfig()})
+	}
+	if *flagWSAddress != "" {
+		config.Listeners = append(config.Listeners, &server.ListenerConfig{Type: server.WebSocketListener, Address: *flagWSAddress, WebSocket: webSocketConfig("")})
+	}
+	for _, spec := range flagListeners {
+		listener, err := parseListener(spec)
+		if err != nil {
+			logger.Fatalf("Invalid -listener %q: %s", spec, err)
+		}
+		config.Listeners = append(config.Listeners, listener)
+	}
+	if *flagPasswordFile != "" {
+		passwords, err := server.NewPasswordFileAuthenticator(*flagPasswordFile, *flagAllowAnonymous)
+		if err != nil {
+			logger.Fatalf("Can't read password file: %s", err)
+		}
+		config.Authenticator = passwords
+		config.AuthMethods = map[string]server.AuthMethod{
+			server.ScramSHA256: server.NewScramSHA256(passwords),
+		}
+	}
+	if *flagACLFile != "" {
+		config.Authorizer, err = server.NewACLFile(*flagACLFile)
+		if err != nil {
+			logger.Fatalf("Can't read ACL file: %s", err)
+		}
+	}
+	if *flagRetainedStore != "" {
+		config.RetainedStore, err = server.NewFileRetainedStore(*flagRetainedStore, *flagCompactionInterval)
+		if err != nil {
+			logger.Fatalf("Can't open retained message store: %s", err)
+		}
+	}
+	if *flagSessionStore != "" {
+		config.SessionStore, err = server.NewFileStore(*flagSessionStore, *flagCompactionInterval)
+		if err != nil {
+			logger.Fatalf("Can't open session store: %s", err)
+		}
+	}
+	srv := server.New(config)
+
+	// Reload certificates on SIGHUP
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			logger.Infof("Got SIGHUP, reloading certificates")
+			if err := srv.ReloadCertificates(); err != nil {
+				logger.Warningf("Can't reload certificates: %s", err)
+			}
+		}
+	}()
+
+	drainOnSignal(srv)
+
+	if err := srv.Start(); err != nil {
+		logger.Fatalf("Can't start server: %s", err)
+	}
 }